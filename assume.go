@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// assumeFailure is an account whose role couldn't be assumed; lookups for
+// its resources fall back to the default credentials
+type assumeFailure struct {
+	Account string `json:"account"`
+	Role    string `json:"role"`
+	Reason  string `json:"reason"`
+}
+
+// accountRoles holds a config per account, signed by the role
+// --assume-all-org-accounts names in that account. An org trail's central
+// bucket is readable with one set of credentials, but the tagging API only
+// sees the calling account's resources.
+type accountRoles struct {
+	cfgs   map[string]aws.Config
+	failed []assumeFailure
+}
+
+// roleARNFor expands --assume-all-org-accounts for one account: a role ARN
+// with an {account} placeholder, or a bare role name
+func roleARNFor(pattern, account string) string {
+	if strings.HasPrefix(pattern, "arn:") {
+		return strings.ReplaceAll(pattern, "{account}", account)
+	}
+	return "arn:aws:iam::" + account + ":role/" + pattern
+}
+
+// logAccounts returns the distinct account IDs in the key paths of objs, the
+// 12-digit segment under AWSLogs/ (or AWSLogs/<org-id>/)
+func logAccounts(objs []logObject) []string {
+	seen := make(map[string]struct{})
+	for _, o := range objs {
+		for _, seg := range strings.Split(aws.ToString(o.obj.Key), "/") {
+			if accountIDRe.MatchString(seg) {
+				seen[seg] = struct{}{}
+				break
+			}
+		}
+	}
+	return sortedKeys(seen)
+}
+
+// assumeAccountRoles assumes the role in every account, listThreads at a
+// time. A failure only costs that account its own lookups, so it's reported
+// and the scan goes on.
+func assumeAccountRoles(ctx context.Context, cfg aws.Config, pattern string, accounts []string) *accountRoles {
+	stscli := sts.NewFromConfig(cfg)
+	roles := &accountRoles{cfgs: make(map[string]aws.Config)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, listThreads)
+	for _, account := range accounts {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			arn := roleARNFor(pattern, account)
+			creds := aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(stscli, arn, func(o *stscreds.AssumeRoleOptions) {
+				o.RoleSessionName = "entrails"
+			}))
+			_, err := creds.Retrieve(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				roles.failed = append(roles.failed, assumeFailure{Account: account, Role: arn, Reason: err.Error()})
+				return
+			}
+			c := cfg.Copy()
+			c.Credentials = creds
+			roles.cfgs[account] = c
+		}()
+	}
+	wg.Wait()
+	sort.Slice(roles.failed, func(i, j int) bool { return roles.failed[i].Account < roles.failed[j].Account })
+
+	fmt.Printf("Assumed the role in %d of %d accounts.\n", len(roles.cfgs), len(accounts))
+	for _, f := range roles.failed {
+		fmt.Fprintf(os.Stderr, "WARNING: can't assume %s (%s); looking up that account's resources with the default credentials.\n", f.Role, f.Reason)
+	}
+	return roles
+}
+
+// has reports whether the role was assumed in the account
+func (r *accountRoles) has(account string) bool {
+	if r == nil {
+		return false
+	}
+	_, ok := r.cfgs[account]
+	return ok
+}
+
+// config returns the account's assumed-role config, or fallback when the
+// account is unknown or its role couldn't be assumed
+func (r *accountRoles) config(account string, fallback aws.Config) aws.Config {
+	if r.has(account) {
+		return r.cfgs[account]
+	}
+	return fallback
+}
@@ -0,0 +1,33 @@
+package main
+
+import "strings"
+
+// attemptStat splits an action's events by outcome, with --count-attempts
+type attemptStat struct {
+	Succeeded int64 `json:"succeeded"`
+	Denied    int64 `json:"denied"`
+	// errors other than denials: throttling, validation, missing resources
+	Failed int64 `json:"failed"`
+}
+
+// isDenial reports whether an errorCode means the call wasn't authorized,
+// which services spell in several ways (AccessDenied, AccessDeniedException,
+// Client.UnauthorizedOperation, ...)
+func isDenial(code string) bool {
+	return strings.Contains(code, "AccessDenied") || strings.Contains(code, "Unauthorized")
+}
+
+// countAttempt tallies one of the identity's events by its outcome; the
+// caller holds r.mu
+func (r *results) countAttempt(action string, errorCode *string) {
+	st := r.attempts[action]
+	switch {
+	case errorCode == nil:
+		st.Succeeded++
+	case isDenial(*errorCode):
+		st.Denied++
+	default:
+		st.Failed++
+	}
+	r.attempts[action] = st
+}
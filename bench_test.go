@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// benchIdentity is the target in the synthetic logs; a quarter of the
+// records are its, the rest belong to other principals
+const benchIdentity = "arn:aws:sts::123456789012:assumed-role/bench-role/session"
+
+// fakeGetter serves every GetObject, ranged or not, from one in-memory log
+// object, so the benchmarks measure the processing path rather than a network
+type fakeGetter struct {
+	blob []byte
+}
+
+func (f fakeGetter) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data := f.blob
+	if rng := aws.ToString(in.Range); rng != "" {
+		from, to, _ := strings.Cut(strings.TrimPrefix(rng, "bytes="), "-")
+		a, _ := strconv.Atoi(from)
+		b, _ := strconv.Atoi(to)
+		data = data[a : min(b+1, len(data))]
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data)), ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+// benchProcess runs b.N objects through process on the given number of
+// workers, the way run feeds its worker pool, and reports the throughput
+func benchProcess(b *testing.B, blob []byte, records, workers int) {
+	sc := &scanner{
+		s3:      fakeGetter{blob},
+		targets: map[string]*results{normalizeArn(benchIdentity): newResults()},
+		stats:   &scanStats{},
+		now:     time.Now(),
+		creds:   &credRefresher{},
+	}
+	jobs := make(chan int, 2*workers)
+	go func() {
+		defer close(jobs)
+		for i := 0; i < b.N; i++ {
+			jobs <- i
+		}
+	}()
+	b.SetBytes(int64(len(blob)))
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				key := fmt.Sprintf("AWSLogs/123456789012/CloudTrail/us-east-1/2024/01/15/bench-%d.json.gz", i)
+				if err := sc.process(context.Background(), "bench", key, int64(len(blob))); err != nil {
+					b.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+	if sc.stats.ObjectsFailed > 0 || sc.stats.ObjectsPartial > 0 {
+		b.Fatalf("%d objects failed, %d partly decoded", sc.stats.ObjectsFailed, sc.stats.ObjectsPartial)
+	}
+	secs := b.Elapsed().Seconds()
+	b.ReportMetric(float64(b.N)/secs, "objects/s")
+	b.ReportMetric(float64(b.N*records)/secs, "records/s")
+}
+
+// BenchmarkProcess sweeps the worker count, records per object and
+// --read-buffer over whole-object GETs
+func BenchmarkProcess(b *testing.B) {
+	defer func(n int) { readBuffer = n }(readBuffer)
+	for _, records := range []int{100, 1000, 10000} {
+		blob := syntheticLog(b, records)
+		for _, buf := range []int{4 << 10, 64 << 10} {
+			for _, workers := range []int{1, 4, 10, 32} {
+				b.Run(fmt.Sprintf("records=%d/buffer=%s/workers=%d", records, humanBytes(int64(buf)), workers), func(b *testing.B) {
+					readBuffer = buf
+					benchProcess(b, blob, records, workers)
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkProcessRanged sweeps --part-size and --part-concurrency, the
+// ranged GETs in flight per object, for a large object fetched in parts
+func BenchmarkProcessRanged(b *testing.B) {
+	defer func(t, s int64, c int) { rangedThreshold, partSize, partConcurrency = t, s, c }(rangedThreshold, partSize, partConcurrency)
+	const records = 50000
+	blob := syntheticLog(b, records)
+	rangedThreshold = 1
+	for _, size := range []int64{1 << 20, 8 << 20} {
+		for _, inflight := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("part=%s/inflight=%d", humanBytes(size), inflight), func(b *testing.B) {
+				partSize, partConcurrency = size, inflight
+				benchProcess(b, blob, records, 4)
+			})
+		}
+	}
+}
+
+// syntheticLog builds a gzipped {"Records":[...]} file of n events shaped
+// like real CloudTrail records, with varied actions, times and parameters
+func syntheticLog(b *testing.B, n int) []byte {
+	actions := []struct{ source, name string }{
+		{"s3.amazonaws.com", "GetObject"},
+		{"ec2.amazonaws.com", "DescribeInstances"},
+		{"sts.amazonaws.com", "AssumeRole"},
+		{"kms.amazonaws.com", "Decrypt"},
+		{"iam.amazonaws.com", "ListRoles"},
+		{"secretsmanager.amazonaws.com", "GetSecretValue"},
+	}
+	records := make([]map[string]any, n)
+	base := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	for i := range records {
+		arn := benchIdentity
+		if i%4 != 0 {
+			arn = fmt.Sprintf("arn:aws:sts::123456789012:assumed-role/other-%d/session", i%50)
+		}
+		a := actions[i%len(actions)]
+		records[i] = map[string]any{
+			"eventVersion": "1.09",
+			"userIdentity": map[string]any{
+				"type":        "AssumedRole",
+				"arn":         arn,
+				"accountId":   "123456789012",
+				"accessKeyId": fmt.Sprintf("ASIA%016d", i),
+			},
+			"eventTime":          base.Add(time.Duration(i) * time.Second).Format(time.RFC3339),
+			"eventSource":        a.source,
+			"eventName":          a.name,
+			"awsRegion":          "us-east-1",
+			"sourceIPAddress":    fmt.Sprintf("203.0.113.%d", i%250),
+			"userAgent":          "aws-cli/2.15.0 Python/3.11.6 Linux/6.1 exe/x86_64",
+			"requestParameters":  map[string]any{"bucketName": "bench-data", "key": fmt.Sprintf("objects/%08d.parquet", i), "secretId": "bench/secret"},
+			"responseElements":   nil,
+			"requestID":          fmt.Sprintf("%016X", i*7919),
+			"eventID":            fmt.Sprintf("00000000-0000-4000-8000-%012d", i),
+			"readOnly":           true,
+			"eventType":          "AwsApiCall",
+			"recipientAccountId": "123456789012",
+		}
+	}
+	data, err := json.Marshal(map[string]any{"Records": records})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// listCheckpoint persists listing progress so an interrupted listing can
+// resume. Every listed page is appended as one JSON line holding its keys and
+// the continuation token for the next page; replaying the file rebuilds both.
+type listCheckpoint struct {
+	mu    sync.Mutex
+	f     *os.File
+	state map[shard]*shardProgress
+}
+
+type shardProgress struct {
+	token   string
+	done    bool
+	objects []types.Object
+}
+
+type checkpointEntry struct {
+	Bucket string          `json:"bucket"`
+	Prefix string          `json:"prefix"`
+	Token  string          `json:"token,omitempty"`
+	Done   bool            `json:"done,omitempty"`
+	Keys   []checkpointKey `json:"keys"`
+}
+
+type checkpointKey struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// openListCheckpoint loads any saved progress from file and positions it for
+// appending. A torn final line from a crash is discarded.
+func openListCheckpoint(file string) (*listCheckpoint, error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	cp := &listCheckpoint{f: f, state: make(map[shard]*shardProgress)}
+
+	dec := json.NewDecoder(f)
+	var good int64
+	for {
+		var e checkpointEntry
+		if err := dec.Decode(&e); err != nil {
+			break
+		}
+		good = dec.InputOffset()
+		sp := cp.progress(shard{bucket: e.Bucket, prefix: e.Prefix})
+		for _, k := range e.Keys {
+			sp.objects = append(sp.objects, types.Object{Key: aws.String(k.Key), Size: aws.Int64(k.Size)})
+		}
+		sp.token = e.Token
+		sp.done = e.Done
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if good > 0 {
+		// the decoder stops before the newline, so put it back
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return cp, nil
+}
+
+func (cp *listCheckpoint) progress(sh shard) *shardProgress {
+	sp, ok := cp.state[sh]
+	if !ok {
+		sp = &shardProgress{}
+		cp.state[sh] = sp
+	}
+	return sp
+}
+
+// resume returns the saved progress for a shard, or nil if it was never
+// listed or no checkpoint is in use
+func (cp *listCheckpoint) resume(sh shard) *shardProgress {
+	if cp == nil {
+		return nil
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.state[sh]
+}
+
+// record appends one listed page to the checkpoint
+func (cp *listCheckpoint) record(sh shard, page *s3.ListObjectsV2Output) error {
+	e := checkpointEntry{
+		Bucket: sh.bucket,
+		Prefix: sh.prefix,
+		Token:  aws.ToString(page.NextContinuationToken),
+		Done:   !aws.ToBool(page.IsTruncated),
+		Keys:   make([]checkpointKey, 0, len(page.Contents)),
+	}
+	for _, obj := range page.Contents {
+		e.Keys = append(e.Keys, checkpointKey{Key: aws.ToString(obj.Key), Size: aws.ToInt64(obj.Size)})
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	_, err = cp.f.Write(append(data, '\n'))
+	return err
+}
+
+// remove deletes the checkpoint once the scan no longer needs it
+func (cp *listCheckpoint) remove() error {
+	cp.f.Close()
+	return os.Remove(cp.f.Name())
+}
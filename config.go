@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig applies --config, a YAML mapping of long flag names to values.
+// Flags given on the command line win over the file, and the file's values
+// go through the same parsing and validation as if they had been typed.
+func loadConfig(flags *pflag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("--config: %w", err)
+	}
+	var doc map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("--config %s: %w", path, err)
+	}
+	for _, name := range sortedKeys(doc) {
+		f := flags.Lookup(name)
+		switch {
+		case f == nil:
+			return fmt.Errorf("--config %s: unknown flag %q", path, name)
+		case name == "config":
+			return fmt.Errorf("--config %s: config files can't include other config files", path)
+		case f.Changed:
+			continue
+		}
+		node := doc[name]
+		values, err := configValues(&node)
+		if err != nil {
+			return fmt.Errorf("--config %s: %s: %w", path, name, err)
+		}
+		multi := strings.HasSuffix(f.Value.Type(), "Slice") || strings.HasSuffix(f.Value.Type(), "Array")
+		if len(values) > 1 && !multi {
+			return fmt.Errorf("--config %s: %s takes a single value, not a list", path, name)
+		}
+		for _, v := range values {
+			if err := flags.Set(name, v); err != nil {
+				return fmt.Errorf("--config %s: %s: %w", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues reads a config entry as the text a flag would be given: a
+// scalar as written, or each item of a list. Scalars are taken verbatim so
+// YAML doesn't reinterpret durations, timestamps or account IDs.
+func configValues(node *yaml.Node) ([]string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []string{node.Value}, nil
+	case yaml.SequenceNode:
+		var values []string
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("list items must be plain values")
+			}
+			values = append(values, item.Value)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("want a value or a list of values")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// configFlags registers one flag of each kind --config has to fill in
+func configFlags() (*pflag.FlagSet, *string, *bool, *time.Duration, *[]string) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	format := flags.String("format", "text", "")
+	stats := flags.Bool("stats", false, "")
+	skew := flags.Duration("clock-skew", 5*time.Minute, "")
+	regions := flags.StringSlice("regions", []string{"us-east-1"}, "")
+	return flags, format, stats, skew, regions
+}
+
+const testConfig = `format: json
+stats: true
+clock-skew: 1h
+regions: [eu-west-1, eu-central-1]
+`
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entrails.yaml")
+	if err := os.WriteFile(path, []byte(testConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		args        []string
+		config      bool
+		wantFormat  string
+		wantStats   bool
+		wantSkew    time.Duration
+		wantRegions []string
+	}{
+		{
+			name:        "defaults without a config file",
+			wantFormat:  "text",
+			wantStats:   false,
+			wantSkew:    5 * time.Minute,
+			wantRegions: []string{"us-east-1"},
+		},
+		{
+			name:        "config file overrides defaults",
+			config:      true,
+			wantFormat:  "json",
+			wantStats:   true,
+			wantSkew:    time.Hour,
+			wantRegions: []string{"eu-west-1", "eu-central-1"},
+		},
+		{
+			name:        "flags override the config file",
+			args:        []string{"--format", "markdown", "--stats=false", "--clock-skew", "30s", "--regions", "ap-south-1"},
+			config:      true,
+			wantFormat:  "markdown",
+			wantStats:   false,
+			wantSkew:    30 * time.Second,
+			wantRegions: []string{"ap-south-1"},
+		},
+		{
+			name:        "flags and config file each fill in their own",
+			args:        []string{"--stats=false", "--regions", "ap-south-1"},
+			config:      true,
+			wantFormat:  "json",
+			wantStats:   false,
+			wantSkew:    time.Hour,
+			wantRegions: []string{"ap-south-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, format, stats, skew, regions := configFlags()
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if tt.config {
+				if err := loadConfig(flags, path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if *format != tt.wantFormat {
+				t.Errorf("format = %q, want %q", *format, tt.wantFormat)
+			}
+			if *stats != tt.wantStats {
+				t.Errorf("stats = %v, want %v", *stats, tt.wantStats)
+			}
+			if *skew != tt.wantSkew {
+				t.Errorf("clock-skew = %v, want %v", *skew, tt.wantSkew)
+			}
+			if !slices.Equal(*regions, tt.wantRegions) {
+				t.Errorf("regions = %q, want %q", *regions, tt.wantRegions)
+			}
+		})
+	}
+}
+
+func TestConfigRejects(t *testing.T) {
+	for name, doc := range map[string]string{
+		"unknown flag":          "no-such-flag: 1\n",
+		"list for single value": "format: [json, text]\n",
+		"unparseable value":     "clock-skew: soon\n",
+		"nested config":         "config: other.yaml\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "entrails.yaml")
+			if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			flags, _, _, _, _ := configFlags()
+			flags.String("config", "", "")
+			if err := loadConfig(flags, path); err == nil {
+				t.Errorf("loadConfig accepted %q", doc)
+			}
+		})
+	}
+}
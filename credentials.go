@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// errCredentialsExpired is returned when temporary credentials run out
+// mid-scan and the credential chain can't hand out new ones
+var errCredentialsExpired = errors.New("AWS credentials expired mid-scan and can't be refreshed; " +
+	"results would be incomplete, so the scan was aborted. Use a profile that refreshes on its own " +
+	"(assume-role, SSO or credential_process) or fresh credentials, and run it again")
+
+// isExpiredToken reports whether an AWS error means the request was signed
+// with credentials that have expired
+func isExpiredToken(err error) bool {
+	var ae smithy.APIError
+	if !errors.As(err, &ae) {
+		return false
+	}
+	switch ae.ErrorCode() {
+	case "ExpiredToken", "ExpiredTokenException", "TokenRefreshRequired":
+		return true
+	}
+	return false
+}
+
+// callerIdentityError explains a failed GetCallerIdentity, telling rejected
+// credentials, which no retry will fix, apart from a transient failure that
+// outlasted the retries
+func callerIdentityError(err error) error {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch code := ae.ErrorCode(); code {
+		case "InvalidClientTokenId", "SignatureDoesNotMatch", "AccessDenied", "ExpiredToken", "UnrecognizedClientException":
+			return fmt.Errorf("can't determine the caller identity: the credentials were rejected (%s); fix them or pass --identity: %w", code, err)
+		}
+	}
+	if sso := credentialError(err); sso != err {
+		return sso
+	}
+	var exhausted *retry.MaxAttemptsError
+	if errors.As(err, &exhausted) {
+		return fmt.Errorf("can't determine the caller identity after %d attempts; this looks transient (network trouble or STS throttling), so try again or raise --max-retries: %w", exhausted.Attempt, err)
+	}
+	return fmt.Errorf("can't determine the caller identity: %w", err)
+}
+
+// credRefresher forces the SDK's credential cache to fetch new credentials
+// when a long scan outlives them. gen counts refreshes so that workers
+// failing on the same stale credentials trigger only one.
+type credRefresher struct {
+	cache *aws.CredentialsCache
+
+	mu  sync.Mutex
+	gen int
+}
+
+func newCredRefresher(cfg aws.Config) *credRefresher {
+	cache, _ := cfg.Credentials.(*aws.CredentialsCache)
+	return &credRefresher{cache: cache}
+}
+
+// generation is the refresh count a request is about to be signed under
+func (cr *credRefresher) generation() int {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.gen
+}
+
+// refresh replaces credentials that expired under generation gen, returning
+// errCredentialsExpired when the provider can't produce different ones
+// (static keys, an exported session token, ...)
+func (cr *credRefresher) refresh(ctx context.Context, gen int) error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.gen != gen {
+		// another worker already refreshed them
+		return nil
+	}
+	if cr.cache == nil {
+		return errCredentialsExpired
+	}
+	old, _ := cr.cache.Retrieve(ctx)
+	cr.cache.Invalidate()
+	creds, err := cr.cache.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("%w (%v)", errCredentialsExpired, err)
+	}
+	if !creds.CanExpire || (creds.AccessKeyID == old.AccessKeyID && creds.SessionToken == old.SessionToken) {
+		return errCredentialsExpired
+	}
+	cr.gen++
+	fmt.Fprintln(os.Stderr, "\nCredentials expired; refreshed them and retrying.")
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// at offset 257 of a POSIX or GNU tar header
+	tarMagic = []byte("ustar")
+)
+
+// defaultReadBuffer is bufio's own default, used when --read-buffer wasn't
+// parsed (selftest, benchmarks)
+const defaultReadBuffer = 4 << 10
+
+// bufferLog wraps a log object's body in a --read-buffer sized reader, or
+// returns it as is when it already is one
+func bufferLog(body io.Reader) *bufio.Reader {
+	size := readBuffer
+	if size <= 0 {
+		size = defaultReadBuffer
+	}
+	return bufio.NewReaderSize(body, size)
+}
+
+// openLog picks a decompressor for a log object by its magic bytes. CloudTrail
+// writes gzip, but archived logs are often recompressed to zstd or bzip2, and
+// some pipelines store plain JSON.
+func openLog(body io.Reader) (io.ReadCloser, error) {
+	br := bufferLog(body)
+	head, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(head, zstdMagic):
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case bytes.HasPrefix(head, bzip2Magic):
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	}
+	if t := bytes.TrimLeft(head, " \t\r\n"); len(t) == 0 || t[0] == '{' {
+		return io.NopCloser(br), nil
+	}
+	return nil, fmt.Errorf("unrecognized compression (starts with % x)", head)
+}
+
+// isTar reports whether a decompressed log object is a tar archive, which
+// archival jobs use to bundle a day's log files into one object
+func isTar(br *bufio.Reader) bool {
+	head, _ := br.Peek(262)
+	// a JSON log starts with '{' and can't be one, even if "ustar" happens
+	// to sit at that offset
+	return len(head) == 262 && head[0] != '{' && bytes.Equal(head[257:262], tarMagic)
+}
+
+// isLogEntry picks the tar entries worth decoding: JSON files, compressed or
+// not. Digest files are JSON as well but hold no events.
+func isLogEntry(name string) bool {
+	base := path.Base(name)
+	for _, ext := range []string{".gz", ".zst", ".bz2"} {
+		base = strings.TrimSuffix(base, ext)
+	}
+	return strings.HasSuffix(base, ".json") && !strings.Contains(name, "CloudTrail-Digest")
+}
+
+// gzipDamage reports what --recover-gzip skipped in an object
+type gzipDamage struct {
+	// stretches of the compressed stream skipped, up to the next member
+	skipped int
+	first   error
+}
+
+func (e *gzipDamage) Error() string {
+	return fmt.Sprintf("skipped %d damaged stretch(es) of gzip data, the first: %v", e.skipped, e.first)
+}
+
+func (e *gzipDamage) Unwrap() error { return e.first }
+
+// gzipMembers decodes a gzip stream one member at a time, handing each
+// member's content to decode. When a member turns out corrupt (a CRC error,
+// bad deflate data, or JSON broken off inside it), the records decode got
+// before the damage stand and reading resumes at the next member header in
+// the compressed bytes. This assumes each member holds whole documents, as
+// concatenated log files and Firehose batches do. It returns a *gzipDamage
+// when anything was skipped.
+func gzipMembers(br *bufio.Reader, decode func(io.Reader) error) error {
+	var damage *gzipDamage
+	zr := new(gzip.Reader)
+	err := zr.Reset(br)
+	for {
+		if err == nil {
+			zr.Multistream(false)
+			if err = decode(zr); err == nil {
+				if err = zr.Reset(br); err == io.EOF {
+					break
+				} else if err == nil {
+					continue
+				}
+			}
+		}
+		if damage == nil {
+			damage = &gzipDamage{first: err}
+		}
+		damage.skipped++
+		if nextGzipMember(br) != nil {
+			break
+		}
+		err = zr.Reset(br)
+	}
+	if damage == nil {
+		return nil
+	}
+	return damage
+}
+
+// nextGzipMember advances br to the next gzip member header (magic and the
+// deflate method byte), returning io.EOF when there is none
+func nextGzipMember(br *bufio.Reader) error {
+	for {
+		head, err := br.Peek(3)
+		if err != nil {
+			return io.EOF
+		}
+		if bytes.HasPrefix(head, gzipMagic) && head[2] == 8 {
+			return nil
+		}
+		br.Discard(1)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "errors"
+
+// Stages a run can fail in. Every error that ends a run is wrapped in a
+// stageError naming one, so callers can tell a bad flag or credentials from
+// a listing or download failure with errors.As.
+const (
+	stageConfig = "config" // flags, policy and rules files, AWS config, credentials
+	stageList   = "list"   // shard discovery, listing and --keys-file
+	stageGet    = "get"    // downloading log objects
+	stageDecode = "decode" // decompressing and parsing log objects
+	stageOutput = "output" // writing the report, --dump-events and uploads
+)
+
+// stageError is an error annotated with the stage it happened in
+type stageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *stageError) Error() string { return e.Stage + ": " + e.Err.Error() }
+
+func (e *stageError) Unwrap() error { return e.Err }
+
+// inStage wraps err with its stage, passing nil through so a writer's result
+// can be returned as is. An error already carrying a stage keeps it.
+func inStage(stage string, err error) error {
+	var se *stageError
+	if err == nil || errors.As(err, &se) {
+		return err
+	}
+	return &stageError{Stage: stage, Err: err}
+}
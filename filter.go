@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+)
+
+// eventFilter is the compiled --filter expression, nil when unset
+var eventFilter *jmespath.JMESPath
+
+func compileFilter(expr string) error {
+	if expr == "" {
+		return nil
+	}
+	f, err := jmespath.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("--filter: %w", err)
+	}
+	eventFilter = f
+	return nil
+}
+
+// filterAllows evaluates --filter against a raw record. Records the
+// expression can't be evaluated against are dropped.
+func filterAllows(raw json.RawMessage) bool {
+	if eventFilter == nil {
+		return true
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return false
+	}
+	v, err := eventFilter.Search(doc)
+	if err != nil {
+		return false
+	}
+	return truthy(v)
+}
+
+// truthy follows JMESPath's notion of truth: false, null and empty strings,
+// arrays and objects are false, everything else is true
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case string:
+		return t != ""
+	case []interface{}:
+		return len(t) > 0
+	case map[string]interface{}:
+		return len(t) > 0
+	}
+	return true
+}
+
+// sourceNets are the parsed --source-ip ranges, nil when unset
+var sourceNets []netip.Prefix
+
+// parseSourceIPs reads --source-ip values, each an address or a CIDR; a bare
+// address is taken as a range of one
+func parseSourceIPs(specs []string) error {
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if p, err := netip.ParsePrefix(spec); err == nil {
+			sourceNets = append(sourceNets, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(spec)
+		if err != nil {
+			return fmt.Errorf("--source-ip wants an IP address or CIDR such as 203.0.113.0/24, got %q", spec)
+		}
+		sourceNets = append(sourceNets, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return nil
+}
+
+// sourceIPAllows reports whether an event's sourceIPAddress is in one of the
+// --source-ip ranges. Calls made by AWS services on the identity's behalf
+// carry a service name there instead, which is never in range.
+func sourceIPAllows(ip string) bool {
+	if sourceNets == nil {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range sourceNets {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// findingRule flags observed actions worth calling out on their own. Actions
+// are service:EventName patterns and may use * and ? wildcards.
+type findingRule struct {
+	Category string   `yaml:"category"`
+	Severity string   `yaml:"severity"`
+	Actions  []string `yaml:"actions"`
+}
+
+//go:embed default-rules.yaml
+var defaultRules []byte
+
+// findingRules is the active ruleset: the embedded defaults, or the file
+// given with --rules
+var findingRules = mustParseRules(defaultRules)
+
+// parseRules reads a rules document. YAML is a superset of JSON, so either
+// works.
+func parseRules(data []byte) ([]findingRule, error) {
+	var doc struct {
+		Rules []findingRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for i, r := range doc.Rules {
+		if r.Category == "" {
+			return nil, fmt.Errorf("rule %d has no category", i+1)
+		}
+		if _, ok := severityWeights[r.Severity]; !ok {
+			return nil, fmt.Errorf("rule %q: unknown severity %q (want low, medium, high or critical)", r.Category, r.Severity)
+		}
+		if len(r.Actions) == 0 {
+			return nil, fmt.Errorf("rule %q has no actions", r.Category)
+		}
+	}
+	return doc.Rules, nil
+}
+
+func mustParseRules(data []byte) []findingRule {
+	rules, err := parseRules(data)
+	if err != nil {
+		panic("default-rules.yaml: " + err.Error())
+	}
+	return rules
+}
+
+// loadRules replaces the active ruleset with the rules in file
+func loadRules(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	rules, err := parseRules(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	findingRules = rules
+	return nil
+}
+
+// crossAccountCategory collects actions that touched resources in another
+// account; it has no action patterns since it's decided per event
+const crossAccountCategory = "Cross-account access"
+
+const crossAccountSeverity = "medium"
+
+// exfilCategory collects the actions that moved data out, once the identity's
+// bytesTransferredOut exceeds --exfil-threshold
+const exfilCategory = "Data exfiltration"
+
+const exfilSeverity = "high"
+
+// severityWeights turn a finding's severity into risk score points per
+// matched action. --severity-weights overrides them.
+var severityWeights = map[string]int{
+	"low":      1,
+	"medium":   3,
+	"high":     7,
+	"critical": 10,
+}
+
+// parseSeverityWeights applies severity=weight pairs over the defaults
+func parseSeverityWeights(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		sev, w, ok := strings.Cut(pair, "=")
+		sev = strings.ToLower(strings.TrimSpace(sev))
+		if !ok {
+			return fmt.Errorf("--severity-weights wants severity=weight pairs, got %q", pair)
+		}
+		if _, known := severityWeights[sev]; !known {
+			return fmt.Errorf("--severity-weights: unknown severity %q (want low, medium, high or critical)", sev)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil || n < 0 {
+			return fmt.Errorf("--severity-weights: bad weight %q for %s", w, sev)
+		}
+		severityWeights[sev] = n
+	}
+	return nil
+}
+
+// finding is a rule category together with the observed actions it matched
+type finding struct {
+	Category string   `json:"category"`
+	Severity string   `json:"severity"`
+	Actions  []string `json:"actions"`
+	// when and in which services a reconnaissance burst happened
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Services []string   `json:"services,omitempty"`
+	// events behind an off-hours finding
+	Events int64 `json:"events,omitempty"`
+}
+
+// classify applies findingRules to the sorted action list, keeping rule order,
+// then adds the identity's cross-account, data exfiltration and off-hours
+// actions and its reconnaissance bursts
+func classify(keys []string, res *results) []finding {
+	var out []finding
+	for _, rule := range findingRules {
+		var matched []string
+		for _, a := range keys {
+			for _, p := range rule.Actions {
+				if wildcardMatch(p, a) {
+					matched = append(matched, a)
+					break
+				}
+			}
+		}
+		if len(matched) > 0 {
+			out = append(out, finding{Category: rule.Category, Severity: rule.Severity, Actions: matched})
+		}
+	}
+	var cross []string
+	for _, a := range keys {
+		if _, ok := res.crossAccount[a]; ok {
+			cross = append(cross, a)
+		}
+	}
+	if len(cross) > 0 {
+		out = append(out, finding{Category: crossAccountCategory, Severity: crossAccountSeverity, Actions: cross})
+	}
+	if exfilThreshold > 0 {
+		// summed over the actions kept, not res.bytesOut, which still counts
+		// those --baseline-policy dropped
+		var moved []string
+		var total int64
+		for _, a := range keys {
+			if n := res.actions[a].BytesOut; n > 0 {
+				moved = append(moved, a)
+				total += n
+			}
+		}
+		if total > exfilThreshold {
+			out = append(out, finding{Category: exfilCategory, Severity: exfilSeverity, Actions: moved})
+		}
+	}
+	if fd, ok := offHoursFinding(keys, res); ok {
+		out = append(out, fd)
+	}
+	return append(out, reconBursts(res)...)
+}
+
+// riskScore weighs each finding's actions by the finding's severity
+func riskScore(findings []finding) int {
+	score := 0
+	for _, fd := range findings {
+		score += severityWeights[fd.Severity] * len(fd.Actions)
+	}
+	return score
+}
+
+// arnAccount returns the account ID field of an ARN, or "" if it has none
+func arnAccount(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 {
+		return ""
+	}
+	return parts[4]
+}
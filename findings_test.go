@@ -0,0 +1,37 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// The exfiltration finding only weighs the actions still reported, so bytes
+// moved by actions --baseline-policy dropped don't set it off
+func TestExfilFindingKeptActions(t *testing.T) {
+	defer func(n int64) { exfilThreshold = n }(exfilThreshold)
+	res := newResults()
+	res.actions["s3:GetObject"] = &actionStat{Count: 2, BytesOut: 400}
+	res.actions["s3:ListBucket"] = &actionStat{Count: 1}
+	// s3:GetObjectVersion moved another 9600 bytes before the baseline
+	// dropped it
+	res.bytesOut = 10000
+
+	for _, tt := range []struct {
+		threshold int64
+		want      []string
+	}{
+		{1000, nil},
+		{100, []string{"s3:GetObject"}},
+	} {
+		exfilThreshold = tt.threshold
+		var got []string
+		for _, fd := range classify(sortedKeys(res.actions), res) {
+			if fd.Category == exfilCategory {
+				got = fd.Actions
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("threshold %d: exfiltration finding on %q, want %q", tt.threshold, got, tt.want)
+		}
+	}
+}
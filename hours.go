@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// offHoursCategory collects the actions the identity called outside
+// --business-hours
+const offHoursCategory = "Off-hours activity"
+
+const offHoursSeverity = "low"
+
+// the --business-hours window as minutes after midnight in bizLocation, end
+// exclusive; bizStart > bizEnd for a window that spans midnight
+var (
+	bizStart, bizEnd int
+	bizLocation      *time.Location
+)
+
+// parseBusinessHours reads --business-hours (HH:MM-HH:MM) and --timezone
+func parseBusinessHours(spec, zone string) error {
+	if spec == "" {
+		return nil
+	}
+	from, to, ok := strings.Cut(spec, "-")
+	start, err1 := time.Parse("15:04", strings.TrimSpace(from))
+	end, err2 := time.Parse("15:04", strings.TrimSpace(to))
+	if !ok || err1 != nil || err2 != nil {
+		return fmt.Errorf("--business-hours wants a range such as 09:00-18:00, got %q", spec)
+	}
+	bizStart, bizEnd = start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	if bizStart == bizEnd {
+		return fmt.Errorf("--business-hours %q is an empty window", spec)
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return fmt.Errorf("--timezone wants an IANA zone such as Europe/Berlin, got %q", zone)
+	}
+	bizLocation = loc
+	return nil
+}
+
+// offHours reports whether t falls outside --business-hours
+func offHours(t time.Time) bool {
+	local := t.In(bizLocation)
+	m := local.Hour()*60 + local.Minute()
+	if bizStart < bizEnd {
+		return m < bizStart || m >= bizEnd
+	}
+	return m < bizStart && m >= bizEnd
+}
+
+// offHoursFinding reports the actions of keys called outside business hours,
+// and how many events that was; ok is false when there were none
+func offHoursFinding(keys []string, res *results) (fd finding, ok bool) {
+	var n int64
+	for _, a := range keys {
+		if c := res.offHours[a]; c > 0 {
+			fd.Actions = append(fd.Actions, a)
+			n += c
+		}
+	}
+	if n == 0 {
+		return finding{}, false
+	}
+	fd.Category, fd.Severity, fd.Events = offHoursCategory, offHoursSeverity, n
+	return fd, true
+}
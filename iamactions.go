@@ -0,0 +1,125 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// eventNameActions maps CloudTrail event names, under their IAM service
+// prefix, to the IAM actions that authorize them where the two differ. Some
+// calls need more than one: a copy reads its source and writes its target.
+var eventNameActions = map[string][]string{
+	"s3:ListBuckets":                                 {"s3:ListAllMyBuckets"},
+	"s3:ListObjects":                                 {"s3:ListBucket"},
+	"s3:ListObjectsV2":                               {"s3:ListBucket"},
+	"s3:HeadBucket":                                  {"s3:ListBucket"},
+	"s3:ListObjectVersions":                          {"s3:ListBucketVersions"},
+	"s3:ListMultipartUploads":                        {"s3:ListBucketMultipartUploads"},
+	"s3:ListParts":                                   {"s3:ListMultipartUploadParts"},
+	"s3:HeadObject":                                  {"s3:GetObject"},
+	"s3:SelectObjectContent":                         {"s3:GetObject"},
+	"s3:CopyObject":                                  {"s3:GetObject", "s3:PutObject"},
+	"s3:UploadPartCopy":                              {"s3:GetObject", "s3:PutObject"},
+	"s3:CreateMultipartUpload":                       {"s3:PutObject"},
+	"s3:UploadPart":                                  {"s3:PutObject"},
+	"s3:CompleteMultipartUpload":                     {"s3:PutObject"},
+	"s3:DeleteObjects":                               {"s3:DeleteObject"},
+	"s3:GetBucketCors":                               {"s3:GetBucketCORS"},
+	"s3:PutBucketCors":                               {"s3:PutBucketCORS"},
+	"s3:DeleteBucketCors":                            {"s3:PutBucketCORS"},
+	"s3:GetBucketEncryption":                         {"s3:GetEncryptionConfiguration"},
+	"s3:PutBucketEncryption":                         {"s3:PutEncryptionConfiguration"},
+	"s3:DeleteBucketEncryption":                      {"s3:PutEncryptionConfiguration"},
+	"s3:GetBucketLifecycle":                          {"s3:GetLifecycleConfiguration"},
+	"s3:GetBucketLifecycleConfiguration":             {"s3:GetLifecycleConfiguration"},
+	"s3:PutBucketLifecycle":                          {"s3:PutLifecycleConfiguration"},
+	"s3:PutBucketLifecycleConfiguration":             {"s3:PutLifecycleConfiguration"},
+	"s3:DeleteBucketLifecycle":                       {"s3:PutLifecycleConfiguration"},
+	"s3:GetBucketReplication":                        {"s3:GetReplicationConfiguration"},
+	"s3:PutBucketReplication":                        {"s3:PutReplicationConfiguration"},
+	"s3:DeleteBucketReplication":                     {"s3:PutReplicationConfiguration"},
+	"s3:DeleteBucketTagging":                         {"s3:PutBucketTagging"},
+	"s3:GetBucketNotificationConfiguration":          {"s3:GetBucketNotification"},
+	"s3:PutBucketNotificationConfiguration":          {"s3:PutBucketNotification"},
+	"s3:GetObjectLockConfiguration":                  {"s3:GetBucketObjectLockConfiguration"},
+	"s3:PutObjectLockConfiguration":                  {"s3:PutBucketObjectLockConfiguration"},
+	"s3:GetBucketAccelerateConfiguration":            {"s3:GetAccelerateConfiguration"},
+	"s3:PutBucketAccelerateConfiguration":            {"s3:PutAccelerateConfiguration"},
+	"s3:GetBucketAnalyticsConfiguration":             {"s3:GetAnalyticsConfiguration"},
+	"s3:ListBucketAnalyticsConfigurations":           {"s3:GetAnalyticsConfiguration"},
+	"s3:PutBucketAnalyticsConfiguration":             {"s3:PutAnalyticsConfiguration"},
+	"s3:DeleteBucketAnalyticsConfiguration":          {"s3:PutAnalyticsConfiguration"},
+	"s3:GetBucketInventoryConfiguration":             {"s3:GetInventoryConfiguration"},
+	"s3:ListBucketInventoryConfigurations":           {"s3:GetInventoryConfiguration"},
+	"s3:PutBucketInventoryConfiguration":             {"s3:PutInventoryConfiguration"},
+	"s3:DeleteBucketInventoryConfiguration":          {"s3:PutInventoryConfiguration"},
+	"s3:GetBucketMetricsConfiguration":               {"s3:GetMetricsConfiguration"},
+	"s3:ListBucketMetricsConfigurations":             {"s3:GetMetricsConfiguration"},
+	"s3:PutBucketMetricsConfiguration":               {"s3:PutMetricsConfiguration"},
+	"s3:DeleteBucketMetricsConfiguration":            {"s3:PutMetricsConfiguration"},
+	"s3:GetBucketIntelligentTieringConfiguration":    {"s3:GetIntelligentTieringConfiguration"},
+	"s3:ListBucketIntelligentTieringConfigurations":  {"s3:GetIntelligentTieringConfiguration"},
+	"s3:PutBucketIntelligentTieringConfiguration":    {"s3:PutIntelligentTieringConfiguration"},
+	"s3:DeleteBucketIntelligentTieringConfiguration": {"s3:PutIntelligentTieringConfiguration"},
+	"s3:DeleteBucketOwnershipControls":               {"s3:PutBucketOwnershipControls"},
+	"s3:DeleteBucketPublicAccessBlock":               {"s3:PutBucketPublicAccessBlock"},
+	"kms:ReEncrypt":                                  {"kms:ReEncryptFrom", "kms:ReEncryptTo"},
+	"lambda:Invoke":                                  {"lambda:InvokeFunction"},
+}
+
+// services whose CloudTrail event names carry the API version they were
+// called through, such as lambda:ListFunctions20150331 or
+// cloudfront:GetDistribution2020_05_31
+var versionedEventSources = map[string]struct{}{
+	"lambda":     {},
+	"cloudfront": {},
+}
+
+var apiVersionSuffixRe = regexp.MustCompile(`([0-9]{8}(v[0-9]+)?|[0-9]{4}_[0-9]{2}_[0-9]{2})$`)
+
+// API Gateway authorizes its management calls by HTTP method rather than by
+// operation; the operation name gives the method away
+var apiGatewayMethods = []struct{ prefix, method string }{
+	{"Get", "GET"}, {"Create", "POST"}, {"Update", "PATCH"}, {"Delete", "DELETE"}, {"Put", "PUT"},
+}
+
+// the HTTP methods among those action names that only read state
+var readOnlyMethods = map[string]struct{}{
+	"GET":     {},
+	"HEAD":    {},
+	"OPTIONS": {},
+}
+
+// iamActions maps a service:EventName pair to the IAM actions that authorize
+// it, reporting false when we can't confidently produce something IAM would
+// accept
+func iamActions(action string) ([]string, bool) {
+	svc, name, ok := strings.Cut(action, ":")
+	if !ok {
+		return nil, false
+	}
+	if _, skip := nonIAMSources[svc]; skip {
+		return nil, false
+	}
+	if mapped, ok := iamPrefixOverrides[svc]; ok {
+		svc = mapped
+	}
+	if _, ok := versionedEventSources[svc]; ok {
+		name = apiVersionSuffixRe.ReplaceAllString(name, "")
+	}
+	if !iamPrefixRe.MatchString(svc) || !iamActionRe.MatchString(name) {
+		return nil, false
+	}
+	if svc == "apigateway" {
+		for _, m := range apiGatewayMethods {
+			if strings.HasPrefix(name, m.prefix) {
+				return []string{"apigateway:" + m.method}, true
+			}
+		}
+		return nil, false
+	}
+	if mapped, ok := eventNameActions[svc+":"+name]; ok {
+		return mapped, true
+	}
+	return []string{svc + ":" + name}, true
+}
@@ -1,281 +1,2573 @@
 package main
 
 import (
-	"compress/gzip"
+	"archive/tar"
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
 	"github.com/spf13/cobra"
 )
 
 var (
-	bucket   string
-	prefix   string
-	profile  string
-	threads  int
-	identity string
-	outfile  string
+	buckets              []string
+	prefixes             []string
+	layout               string
+	delimiter            string
+	profile              string
+	configPath           string // --config; configFile is the AWS shared config
+	credentialsFile      string
+	configFile           string
+	threads              int
+	threadsSpec          string
+	listThreads          int
+	onError              string
+	maxRetries           int
+	queueDepth           int
+	readBufferSpec       string
+	readBuffer           int
+	recoverGzip          bool
+	rangedThresholdSpec  string
+	rangedThreshold      int64
+	partSizeSpec         string
+	partSize             int64
+	partConcurrency      int
+	identity             string
+	ignoreCase           bool
+	compareIDs           []string
+	listIDs              bool
+	appendOutput         bool
+	outfile              string
+	topN                 int
+	dumpEvents           string
+	sqlitePath           string
+	dedupe               bool
+	showSources          bool
+	showSessions         bool
+	countAttempts        bool
+	listResources        bool
+	explain              bool
+	groupByDate          bool
+	format               string
+	generatePolicy       bool
+	templateSpec         string
+	matrixBy             string
+	inputFraming         string
+	baseline             string
+	currentPolicy        string
+	policyConditionSpec  string
+	splitReadWrite       bool
+	statementsPerService bool
+	serviceResources     []string
+	showStats            bool
+	estimateOnly         bool
+	confirmThreshold     int64
+	assumeYes            bool
+	metricsAddr          string
+	keyInclude           []string
+	keyExclude           []string
+	sampleRate           float64
+	recentPerShard       int
+
+	listCheckpointFile  string
+	keysFile            string
+	readStdin           bool
+	resourceTag         string
+	assumeRolePattern   string
+	filterExpr          string
+	eventRegions        []string
+	sourceIPSpecs       []string
+	trailRegions        []string
+	startTimeSpec       string
+	endTimeSpec         string
+	severityWeightsSpec string
+	exfilThresholdSpec  string
+	exfilThreshold      int64
+	reconThreshold      int
+	reconWindow         time.Duration
+	businessHours       string
+	timezone            string
+	rulesFile           string
+	futureEvents        string
+	clockSkew           time.Duration
+	quiet               bool
+	redactMode          string
+	excludeSLR          bool
 )
 
-// convert sts ARNs to iam ARNs and strips session suffixes
+// normalizeArn turns an assumed-role session ARN into the ARN of its role, so
+// every session of a role counts as that role. Session ARNs don't carry the
+// role's path, so it's dropped from role ARNs as well. User names are unique
+// within an account whatever their path, so user ARNs lose theirs too and
+// user/alice matches arn:aws:iam::<account>:user/engineering/alice. Other
+// ARNs are kept as they are.
 func normalizeArn(raw string) string {
-	arn := strings.Replace(raw, "arn:aws:sts::", "arn:aws:iam::", 1)
-	// handle assumed-role vs role
-	arn = strings.Replace(arn, ":assumed-role/", ":role/", 1)
-	// strip any session or path after first /
-	if idx := strings.Index(arn, "/"); idx != -1 {
-		arn = arn[:idx]
+	if head, rest, ok := strings.Cut(raw, ":role/"); ok && strings.Contains(head, ":iam:") {
+		return head + ":role/" + rest[strings.LastIndex(rest, "/")+1:]
+	}
+	if head, rest, ok := strings.Cut(raw, ":user/"); ok && strings.Contains(head, ":iam:") {
+		return head + ":user/" + rest[strings.LastIndex(rest, "/")+1:]
+	}
+	head, rest, ok := strings.Cut(raw, ":assumed-role/")
+	if !ok || !strings.Contains(head, ":sts:") {
+		return raw
+	}
+	// arn:aws:sts::<account>:assumed-role/<role>/<session>
+	role, _, _ := strings.Cut(rest, "/")
+	return strings.Replace(head, ":sts:", ":iam:", 1) + ":role/" + role
+}
+
+// sessionName returns the session an assumed-role ARN names, the part
+// normalizeArn drops, or "" for any other ARN
+func sessionName(raw string) string {
+	head, rest, ok := strings.Cut(raw, ":assumed-role/")
+	if !ok || !strings.Contains(head, ":sts:") {
+		return ""
+	}
+	_, session, _ := strings.Cut(rest, "/")
+	return session
+}
+
+// arnResource returns the resource part of an ARN (user/alice, role/Admin)
+func arnResource(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 {
+		return ""
+	}
+	return parts[5]
+}
+
+// normalizeTarget prepares an --identity or --compare-identities value:
+// ARNs are normalized like event identities, while a bare resource such as
+// user/alice is kept to match that name in any account
+func normalizeTarget(id string) (string, error) {
+	if strings.HasPrefix(id, "arn:") {
+		return normalizeArn(id), nil
+	}
+	if !strings.Contains(id, "/") {
+		return "", fmt.Errorf("identity %q is neither an ARN nor a bare user/<name> or role/<name>", id)
+	}
+	for _, kind := range []string{"role/", "user/"} {
+		if strings.HasPrefix(id, kind) {
+			return kind + id[strings.LastIndex(id, "/")+1:], nil
+		}
+	}
+	return id, nil
+}
+
+// isServiceLinkedRole reports whether an identity ARN belongs to a
+// service-linked role, which AWS services assume to act on their own behalf.
+// Their names start with AWSServiceRoleFor and they live under the
+// aws-service-role/ path, which assumed-role ARNs don't carry.
+func isServiceLinkedRole(arn string) bool {
+	if strings.Contains(arn, ":role/aws-service-role/") {
+		return true
+	}
+	_, name, ok := strings.Cut(arn, ":assumed-role/")
+	if !ok {
+		_, name, ok = strings.Cut(arn, ":role/")
+	}
+	return ok && strings.HasPrefix(name, "AWSServiceRoleFor")
+}
+
+// arnCacheLimit bounds the normalization cache; CloudTrail sees few distinct
+// principals, so hitting it means something unusual and we simply start over
+const arnCacheLimit = 10000
+
+var (
+	arnCache     atomic.Pointer[sync.Map]
+	arnCacheSize atomic.Int64
+)
+
+// normalizeArnCached memoizes normalizeArn, which runs for every record
+func normalizeArnCached(raw string) string {
+	m := arnCache.Load()
+	if m == nil {
+		arnCache.CompareAndSwap(nil, &sync.Map{})
+		m = arnCache.Load()
+	}
+	if v, ok := m.Load(raw); ok {
+		return v.(string)
+	}
+	norm := normalizeArn(raw)
+	if arnCacheSize.Add(1) > arnCacheLimit {
+		arnCache.Store(&sync.Map{})
+		arnCacheSize.Store(0)
+		return norm
+	}
+	m.Store(raw, norm)
+	return norm
+}
+
+func main() {
+	root := &cobra.Command{
+		Use:     "cloudtrail2iam",
+		Short:   "Analyze CloudTrail logs for successful actions by identity",
+		PreRunE: validateFlags,
+		RunE:    run,
+		// main reports errors, once, with their stage
+		SilenceErrors: true,
+	}
+
+	root.Flags().StringSliceVar(&buckets, "bucket", nil, "S3 bucket name or access point ARN; repeat or comma-separate to scan several buckets")
+	root.Flags().StringSliceVar(&prefixes, "prefix", nil, "S3 prefix for CloudTrail logs (e.g. AWSLogs/<acc-id>/CloudTrail/); one per bucket, or one shared by all")
+	root.Flags().StringVar(&layout, "layout", "auto", "Trail layout under AWSLogs/: org (AWSLogs/<org-id>/<account>/...), account, or auto to detect it")
+	root.Flags().StringVar(&delimiter, "delimiter", "/", "Key delimiter shard discovery splits on, for custom layouts whose shard boundaries aren't '/'")
+	root.Flags().StringSliceVar(&trailRegions, "regions", nil, "Only discover and list these region folders of the trail (the /us-east-1/ key segment); all regions when unset")
+	root.Flags().StringVar(&startTimeSpec, "start-time", "", "Only count events from this time on, and only list the day folders that can hold them (RFC 3339 or YYYY-MM-DD)")
+	root.Flags().StringVar(&endTimeSpec, "end-time", "", "With --start-time, only count events up to this time and list day folders up to it (default: no end)")
+	root.Flags().StringSliceVar(&keyInclude, "key-include", nil, "Only process object keys matching one of these globs (e.g. '*/CloudTrail/*')")
+	root.Flags().StringSliceVar(&keyExclude, "key-exclude", nil, "Skip object keys matching any of these globs (e.g. '*/CloudTrail-Digest/*')")
+	root.Flags().IntVar(&recentPerShard, "recent-per-shard", 0, "Only process the newest N log files (by key) of each shard prefix, for a quick look at recent activity")
+	root.Flags().Float64Var(&sampleRate, "sample-rate", 1, "Only process this fraction (0-1] of log files, picked deterministically by key; results are incomplete")
+	root.Flags().StringVar(&listCheckpointFile, "list-checkpoint", "", "Persist listing progress to this file and resume from it if present")
+	root.Flags().BoolVar(&readStdin, "stdin", false, "Read CloudTrail JSON (Records files or one event per line, possibly compressed) from stdin instead of S3; needs no AWS credentials")
+	root.Flags().StringVar(&keysFile, "keys-file", "", "Process exactly the objects listed in this file (one key or s3:// URI per line), skipping discovery and listing")
+	root.Flags().StringVar(&configPath, "config", "", "Read flag values from this YAML file; flags given on the command line override it")
+	root.Flags().StringVar(&profile, "profile", "", "AWS CLI profile to use")
+	root.Flags().StringVar(&credentialsFile, "credentials-file", "", "Read shared credentials from this file instead of ~/.aws/credentials")
+	root.Flags().StringVar(&configFile, "config-file", "", "Read shared config from this file instead of ~/.aws/config")
+	root.Flags().StringVar(&threadsSpec, "threads", "10", "Number of workers for processing logs, or auto to size from CPUs and object size")
+	root.Flags().IntVar(&listThreads, "list-threads", 10, "Concurrent listing requests during shard discovery and listing")
+	root.Flags().StringVar(&onError, "on-error", "continue", "When a prefix can't be listed: continue (skip it and report it as incomplete) or fail (abort the scan)")
+	root.Flags().IntVar(&queueDepth, "worker-queue-depth", 0, "Objects buffered ahead of the workers (default 2x --threads)")
+	root.Flags().BoolVar(&recoverGzip, "recover-gzip", false, "On corrupt gzip data, skip to the next gzip member and keep decoding instead of giving up on the rest of the object")
+	root.Flags().StringVar(&readBufferSpec, "read-buffer", "4KiB", "Read buffer per log object download, e.g. 64KiB")
+	root.Flags().StringVar(&rangedThresholdSpec, "ranged-threshold", "", "Fetch objects larger than this, e.g. 64MiB, as concurrent ranged GETs of --part-size (off by default)")
+	root.Flags().StringVar(&partSizeSpec, "part-size", "8MiB", "Size of each ranged GET with --ranged-threshold")
+	root.Flags().IntVar(&partConcurrency, "part-concurrency", 4, "Ranged GETs in flight per large object with --ranged-threshold")
+	root.Flags().IntVar(&maxRetries, "max-retries", 2, "Retries per AWS request on throttling and transient errors")
+	root.Flags().StringVar(&identity, "identity", "", "Filter by identity ARN, or user/<name> or role/<name> in any account (default: caller identity)")
+	root.Flags().BoolVar(&ignoreCase, "ignore-case", false, "Match identity ARNs case-insensitively (ARNs are case-sensitive, so this can merge distinct principals)")
+	root.Flags().BoolVar(&listIDs, "list-identities", false, "Discover active identities and their event counts instead of filtering by one")
+	root.Flags().StringSliceVar(&compareIDs, "compare-identities", nil, "Compare two identity ARNs (comma-separated) and report actions only one of them performed")
+	root.Flags().StringVar(&outfile, "output", "", "Write results to this file (optional)")
+	root.Flags().IntVar(&topN, "top-n", 0, "Only list the N most frequent actions (0 lists all)")
+	root.Flags().StringVar(&redactMode, "redact", "", "Hide identifiers in the results for sharing: accounts (account IDs become per-run pseudonyms) or arns (also mask ARN resource names)")
+	root.Flags().BoolVarP(&quiet, "quiet", "q", false, "With --output and --format text, only write the results to the file instead of also printing them")
+	root.Flags().BoolVar(&appendOutput, "append", false, "Append to --output with a per-run header instead of overwriting it")
+	root.Flags().BoolVar(&generatePolicy, "generate-policy", false, "Write the observed actions as a least-privilege IAM policy document; the same as --format iam-policy")
+	root.Flags().StringVar(&format, "format", "text", "Output format: text, table, json, json-per-identity (one JSON line per identity, then stats), markdown, matrix-csv, iam-policy or boundary (a permissions boundary)")
+	root.Flags().StringVar(&templateSpec, "template", "", "Render the results with this Go text/template (inline, or a path to a template file) instead of --format")
+	root.Flags().StringVar(&matrixBy, "matrix-by", "account", "Columns for --format matrix-csv: account (recipientAccountId) or region")
+	root.Flags().StringVar(&inputFraming, "input-framing", "auto", "Log file framing: records (CloudTrail {\"Records\":[...]}), ndjson (one event per line, e.g. Firehose) or auto")
+	root.Flags().BoolVar(&estimateOnly, "estimate-only", false, "List objects and estimate download size and cost without processing them")
+	root.Flags().Int64Var(&confirmThreshold, "confirm-threshold", 100000, "Ask before processing more than this many log files (0 never asks)")
+	root.Flags().BoolVarP(&assumeYes, "yes", "y", false, "Don't ask for confirmation before large scans")
+	root.Flags().StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics on this address (e.g. :9090) while the scan runs")
+	root.Flags().BoolVar(&showStats, "stats", false, "Report scan statistics (always included in json output)")
+	root.Flags().BoolVar(&splitReadWrite, "split-read-write", false, "With --format iam-policy, emit separate statements for read-only and write actions")
+	root.Flags().BoolVar(&statementsPerService, "statements-per-service", false, "With --format iam-policy, emit one statement per service, with a Sid such as S3Access")
+	root.Flags().StringArrayVar(&serviceResources, "service-resource", nil, "With --statements-per-service, use this Resource for a service's statements instead of *, as service=ARN; repeatable")
+	root.Flags().StringVar(&policyConditionSpec, "policy-condition", "", "With --format iam-policy or boundary, attach this Condition (JSON object or key,value pairs)")
+	root.Flags().StringVar(&baseline, "baseline-policy", "", "Only report actions not granted by this IAM policy JSON file")
+	root.Flags().StringVar(&currentPolicy, "current-policy", "", "Report the actions this IAM policy JSON file grants that the identity never used")
+	root.Flags().StringSliceVar(&eventRegions, "event-region", nil, "Only count events whose API call happened in these regions (the event's awsRegion)")
+	root.Flags().StringSliceVar(&sourceIPSpecs, "source-ip", nil, "Only count events made from these IP addresses or CIDR ranges (the event's sourceIPAddress)")
+	root.Flags().StringVar(&resourceTag, "resource-tag", "", "Only count events touching a resource tagged key=value (looked up via the tagging API)")
+	root.Flags().StringVar(&assumeRolePattern, "assume-all-org-accounts", "", "Assume this role (a name, or an ARN with {account}) in every account under the prefixes for its --resource-tag lookups")
+	root.Flags().StringVar(&filterExpr, "filter", "", "Only count events for which this JMESPath expression is truthy, e.g. \"contains(userAgent, 'curl')\"")
+	root.Flags().StringVar(&rulesFile, "rules", "", "YAML or JSON file of finding rules to use instead of the built-in set")
+	root.Flags().StringVar(&exfilThresholdSpec, "exfil-threshold", "", "Raise a data exfiltration finding when the identity's bytesTransferredOut adds up to more than this, e.g. 5GB or 500MiB")
+	root.Flags().IntVar(&reconThreshold, "recon-threshold", 10, "Raise a reconnaissance finding when the identity calls this many distinct read-only actions, in at least 3 services, within --recon-window (0 disables it)")
+	root.Flags().DurationVar(&reconWindow, "recon-window", 10*time.Minute, "Time window for --recon-threshold")
+	root.Flags().StringVar(&businessHours, "business-hours", "", "Raise an off-hours finding for the actions called outside this daily window, e.g. 09:00-18:00 (22:00-06:00 spans midnight)")
+	root.Flags().StringVar(&timezone, "timezone", "UTC", "IANA time zone --business-hours is in, e.g. Europe/Berlin")
+	root.Flags().StringVar(&severityWeightsSpec, "severity-weights", "", "Risk score points per finding action by severity, e.g. high=5,critical=20")
+	root.Flags().BoolVar(&excludeSLR, "exclude-slr", false, "Drop events by service-linked roles (AWSServiceRoleFor...) instead of reporting them in their own section")
+	root.Flags().StringVar(&futureEvents, "future-events", "flag", "Events dated after now plus --clock-skew: flag (count them but report them as suspicious) or drop")
+	root.Flags().DurationVar(&clockSkew, "clock-skew", 5*time.Minute, "How far past the current time an eventTime may be before it counts as future-dated")
+	root.Flags().BoolVar(&showSources, "show-sources", false, "Report distinct source IPs and user agents for the identity")
+	root.Flags().BoolVar(&countAttempts, "count-attempts", false, "Also count every event of the identity per action, failed ones included, as succeeded, denied and failed")
+	root.Flags().BoolVar(&showSessions, "show-sessions", false, "Report the distinct session names a role was assumed under, with their event counts")
+	root.Flags().BoolVar(&groupByDate, "group-by-date", false, "List the identity's actions under a heading for each UTC day it was active, as a daily activity log")
+	root.Flags().BoolVar(&explain, "explain", false, "Show one example event (the earliest) behind each action, to check what was attributed to the identity and why")
+	root.Flags().BoolVar(&listResources, "list-resources", false, "Report every distinct resource ARN the identity's events touched, across all actions")
+	root.Flags().StringVar(&dumpEvents, "dump-events", "", "Write every matched raw event to this NDJSON file (optional)")
+	root.Flags().StringVar(&sqlitePath, "sqlite", "", "Also append the identities, actions, resources and secrets found to this SQLite database, created if missing")
+	root.Flags().BoolVar(&dedupe, "dedupe", false, "Count events delivered by several trails once, keyed on eventID (keeps every matched eventID in memory)")
+
+	root.AddCommand(selftestCmd)
+	mergeCmd.Flags().StringVar(&mergeOutput, "output", "", "File to write the merged result to (stdout when unset)")
+	mergeCmd.Flags().StringVar(&mergeFormat, "format", "", "json or json-per-identity; json when the inputs cover one identity, json-per-identity otherwise")
+	root.AddCommand(mergeCmd)
+
+	// debugging aid: shows what an ARN looks like after normalizeArn, i.e.
+	// what --identity has to match
+	root.AddCommand(&cobra.Command{
+		Use:    "normalize <arn>...",
+		Short:  "Print the normalized form of identity ARNs and exit",
+		Hidden: true,
+		Args:   cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			for _, arn := range args {
+				fmt.Println(normalizeArn(arn))
+			}
+		},
+	})
+
+	if err := root.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// validateFlags rejects unknown values and combinations that would otherwise
+// be silently ignored, before any AWS calls are made
+func validateFlags(cmd *cobra.Command, args []string) error {
+	if configPath != "" {
+		if err := loadConfig(cmd.Flags(), configPath); err != nil {
+			return err
+		}
+	}
+	if generatePolicy {
+		if cmd.Flags().Changed("format") && format != "iam-policy" {
+			return fmt.Errorf("--generate-policy writes --format iam-policy, not %s", format)
+		}
+		format = "iam-policy"
+	}
+	switch format {
+	case "text", "table", "json", "json-per-identity", "markdown", "matrix-csv", "iam-policy", "boundary":
+	default:
+		return fmt.Errorf("unknown --format %q (want text, table, json, json-per-identity, markdown, matrix-csv, iam-policy or boundary)", format)
+	}
+	switch matrixBy {
+	case "account", "region":
+	default:
+		return fmt.Errorf("--matrix-by must be account or region, got %q", matrixBy)
+	}
+	if cmd.Flags().Changed("matrix-by") && format != "matrix-csv" {
+		return fmt.Errorf("--matrix-by only applies to --format matrix-csv")
+	}
+	if listThreads < 1 {
+		return fmt.Errorf("--list-threads must be at least 1")
+	}
+	if templateSpec != "" {
+		if cmd.Flags().Changed("format") || listIDs || len(compareIDs) > 0 {
+			return fmt.Errorf("--template renders a single identity's results and replaces --format")
+		}
+		if err := parseTemplate(templateSpec); err != nil {
+			return err
+		}
+	}
+	if exfilThresholdSpec != "" {
+		n, err := parseSize(exfilThresholdSpec)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("--exfil-threshold wants a positive size such as 5GB or 500MiB, got %q", exfilThresholdSpec)
+		}
+		exfilThreshold = n
+	}
+	for _, r := range trailRegions {
+		if !regionSegRe.MatchString(r) {
+			return fmt.Errorf("--regions wants region names such as us-east-1, got %q", r)
+		}
+	}
+	if startTimeSpec != "" {
+		start, err := parseWindowTime("start-time", startTimeSpec)
+		if err != nil {
+			return err
+		}
+		end := time.Now()
+		if endTimeSpec != "" {
+			if end, err = parseWindowTime("end-time", endTimeSpec); err != nil {
+				return err
+			}
+			windowEnd = end
+		}
+		if end.Before(start) && endTimeSpec == "" {
+			return fmt.Errorf("--start-time %s is in the future", startTimeSpec)
+		} else if end.Before(start) {
+			return fmt.Errorf("--end-time %s is before --start-time %s", endTimeSpec, startTimeSpec)
+		}
+		windowStart = start
+		setWindowDays(start, end)
+	} else if endTimeSpec != "" {
+		return fmt.Errorf("--end-time needs a --start-time")
+	}
+	if recentPerShard < 0 {
+		return fmt.Errorf("--recent-per-shard must be positive, got %d", recentPerShard)
+	}
+	if delimiter == "" {
+		return fmt.Errorf("--delimiter can't be empty")
+	}
+	if delimiter != "/" && cmd.Flags().Changed("layout") {
+		return fmt.Errorf("--layout describes the standard AWSLogs/ layout and can't be combined with a custom --delimiter")
+	}
+	switch onError {
+	case "continue", "fail":
+	default:
+		return fmt.Errorf("--on-error must be continue or fail, got %q", onError)
+	}
+	if onError == "fail" && keysFile != "" {
+		return fmt.Errorf("--on-error governs listing, which --keys-file skips")
+	}
+	switch redactMode {
+	case "", "accounts", "arns":
+	default:
+		return fmt.Errorf("--redact must be accounts or arns, got %q", redactMode)
+	}
+	if redactMode != "" && dumpEvents != "" {
+		return fmt.Errorf("--redact doesn't apply to the raw events --dump-events writes")
+	}
+	if redactMode != "" && sqlitePath != "" {
+		return fmt.Errorf("--redact doesn't apply to the --sqlite database")
+	}
+	if sqlitePath != "" && listIDs {
+		return fmt.Errorf("--sqlite records identities' actions, which --list-identities doesn't collect")
+	}
+	if quiet && (outfile == "" || format != "text" || templateSpec != "") {
+		return fmt.Errorf("--quiet only applies to --format text with --output")
+	}
+	switch futureEvents {
+	case "flag", "drop":
+	default:
+		return fmt.Errorf("--future-events must be flag or drop, got %q", futureEvents)
+	}
+	if reconThreshold < 0 {
+		return fmt.Errorf("--recon-threshold can't be negative")
+	}
+	if reconWindow < time.Minute {
+		return fmt.Errorf("--recon-window must be at least 1m, got %s", reconWindow)
+	}
+	if cmd.Flags().Changed("timezone") && businessHours == "" {
+		return fmt.Errorf("--timezone only applies to --business-hours")
+	}
+	if err := parseBusinessHours(businessHours, timezone); err != nil {
+		return err
+	}
+	if clockSkew < 0 {
+		return fmt.Errorf("--clock-skew can't be negative")
+	}
+	if countAttempts && (listIDs || len(compareIDs) > 0 || policyFormat() || format == "matrix-csv") {
+		return fmt.Errorf("--count-attempts only applies to a single-identity scan with --format text, table, markdown, json or json-per-identity")
+	}
+	if groupByDate && (listIDs || len(compareIDs) > 0 || format == "table" || policyFormat() || format == "matrix-csv") {
+		return fmt.Errorf("--group-by-date only applies to a single-identity scan with --format text, markdown, json or json-per-identity")
+	}
+	if currentPolicy != "" && (listIDs || len(compareIDs) > 0 || policyFormat() || format == "matrix-csv") {
+		return fmt.Errorf("--current-policy only applies to a single-identity report")
+	}
+	if explain && (listIDs || len(compareIDs) > 0 || format == "table" || policyFormat() || format == "matrix-csv") {
+		return fmt.Errorf("--explain only applies to a single identity's text, markdown or json report")
+	}
+	if explain && groupByDate {
+		return fmt.Errorf("--explain shows an event next to each action, and --group-by-date lists the actions by day instead")
+	}
+	if listResources && (listIDs || len(compareIDs) > 0 || policyFormat() || format == "matrix-csv") {
+		return fmt.Errorf("--list-resources only applies to a single identity's text, table, json or markdown report")
+	}
+	if listIDs {
+		if identity != "" || len(compareIDs) > 0 {
+			return fmt.Errorf("--list-identities can't be combined with --identity or --compare-identities")
+		}
+		if format != "text" && format != "json" && format != "json-per-identity" {
+			return fmt.Errorf("--list-identities supports --format text, json or json-per-identity")
+		}
+	}
+	if len(compareIDs) > 0 {
+		if len(compareIDs) != 2 {
+			return fmt.Errorf("--compare-identities takes exactly two identity ARNs")
+		}
+		if identity != "" {
+			return fmt.Errorf("--identity and --compare-identities are mutually exclusive")
+		}
+		if format != "text" && format != "json" && format != "json-per-identity" {
+			return fmt.Errorf("--compare-identities supports --format text, json or json-per-identity")
+		}
+	}
+	// the SDK quietly skips shared files it can't find
+	for _, f := range []struct{ flag, path string }{{"credentials-file", credentialsFile}, {"config-file", configFile}} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			return fmt.Errorf("--%s: %w", f.flag, err)
+		}
+	}
+	switch layout {
+	case "auto", "org", "account":
+	default:
+		return fmt.Errorf("--layout must be auto, org or account, got %q", layout)
+	}
+	switch inputFraming {
+	case "records", "ndjson", "auto":
+	default:
+		return fmt.Errorf("--input-framing must be records, ndjson or auto, got %q", inputFraming)
+	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		return fmt.Errorf("--sample-rate must be greater than 0 and at most 1, got %g", sampleRate)
+	}
+	if sampleRate < 1 && policyFormat() {
+		return fmt.Errorf("--sample-rate can't be used with --format %s; a sampled policy would be missing actions", format)
+	}
+	if confirmThreshold < 0 {
+		return fmt.Errorf("--confirm-threshold can't be negative")
+	}
+	if maxRetries < 0 {
+		return fmt.Errorf("--max-retries can't be negative")
+	}
+	if topN < 0 {
+		return fmt.Errorf("--top-n can't be negative")
+	}
+	if identity != "" {
+		var err error
+		if identity, err = normalizeTarget(identity); err != nil {
+			return err
+		}
+	}
+	for i, id := range compareIDs {
+		var err error
+		if compareIDs[i], err = normalizeTarget(id); err != nil {
+			return err
+		}
+	}
+	if len(compareIDs) == 2 && compareIDs[0] == compareIDs[1] {
+		return fmt.Errorf("--compare-identities got the same identity twice")
+	}
+	if ignoreCase && len(compareIDs) == 2 && strings.EqualFold(compareIDs[0], compareIDs[1]) {
+		return fmt.Errorf("--compare-identities names the same identity twice under --ignore-case")
+	}
+	if topN > 0 && len(compareIDs) > 0 {
+		return fmt.Errorf("--top-n can't be used with --compare-identities")
+	}
+	if topN > 0 && policyFormat() {
+		return fmt.Errorf("--top-n can't be used with --format %s; the policy needs every action", format)
+	}
+	if threadsSpec == "auto" {
+		threads = 0
+	} else if n, err := strconv.Atoi(threadsSpec); err != nil || n < 1 {
+		return fmt.Errorf("--threads must be a number of at least 1 or auto, got %q", threadsSpec)
+	} else {
+		threads = n
+	}
+	n, err := parseSize(readBufferSpec)
+	if err != nil || n < 16 || n > 64<<20 {
+		return fmt.Errorf("--read-buffer wants a size from 16B to 64MiB, got %q", readBufferSpec)
+	}
+	readBuffer = int(n)
+	if queueDepth < 0 {
+		return fmt.Errorf("--worker-queue-depth can't be negative")
+	}
+	if rangedThresholdSpec != "" {
+		n, err := parseSize(rangedThresholdSpec)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("--ranged-threshold wants a positive size such as 64MiB, got %q", rangedThresholdSpec)
+		}
+		rangedThreshold = n
+		if partSize, err = parseSize(partSizeSpec); err != nil || partSize < 1<<20 {
+			return fmt.Errorf("--part-size wants a size of at least 1MiB, got %q", partSizeSpec)
+		}
+		if partConcurrency < 1 {
+			return fmt.Errorf("--part-concurrency must be at least 1")
+		}
+		if keysFile != "" {
+			return fmt.Errorf("--ranged-threshold goes by the sizes listing reports, which --keys-file skips")
+		}
+	} else if cmd.Flags().Changed("part-size") || cmd.Flags().Changed("part-concurrency") {
+		return fmt.Errorf("--part-size and --part-concurrency only apply to --ranged-threshold")
+	}
+	if readStdin {
+		// everything about finding, fetching and paying for log objects
+		for _, name := range []string{"bucket", "prefix", "layout", "delimiter", "regions", "key-include",
+			"key-exclude", "recent-per-shard", "sample-rate", "list-checkpoint", "keys-file", "profile", "credentials-file", "config-file",
+			"threads", "list-threads", "on-error", "worker-queue-depth", "ranged-threshold", "max-retries", "estimate-only", "confirm-threshold", "yes",
+			"resource-tag", "assume-all-org-accounts"} {
+			if cmd.Flags().Changed(name) {
+				return fmt.Errorf("--%s can't be used with --stdin, which reads no S3 objects", name)
+			}
+		}
+		if identity == "" && len(compareIDs) == 0 && !listIDs {
+			return fmt.Errorf("--stdin needs --identity, --compare-identities or --list-identities; the caller identity isn't looked up")
+		}
+		if _, _, isS3 := parseS3URI(outfile); isS3 {
+			return fmt.Errorf("--output can't be an s3:// URI with --stdin, which makes no AWS calls")
+		}
+	} else if keysFile != "" {
+		switch {
+		case len(buckets) != 1:
+			return fmt.Errorf("--keys-file takes exactly one --bucket, used for keys without an s3:// bucket")
+		case len(prefixes) > 0:
+			return fmt.Errorf("--prefix can't be used with --keys-file, which skips listing")
+		case listCheckpointFile != "":
+			return fmt.Errorf("--list-checkpoint can't be used with --keys-file, which skips listing")
+		case cmd.Flags().Changed("delimiter"):
+			return fmt.Errorf("--delimiter can't be used with --keys-file, which skips discovery")
+		case cmd.Flags().Changed("list-threads"):
+			return fmt.Errorf("--list-threads can't be used with --keys-file, which skips listing")
+		case len(trailRegions) > 0:
+			return fmt.Errorf("--regions can't be used with --keys-file, which skips discovery")
+		case recentPerShard > 0:
+			return fmt.Errorf("--recent-per-shard can't be used with --keys-file, which skips listing")
+		}
+		if err := checkAccessPoint(buckets[0]); err != nil {
+			return err
+		}
+	} else if _, err := bucketTargets(buckets, prefixes); err != nil {
+		return err
+	}
+	if policyFormat() {
+		for _, name := range []string{"show-sources", "show-sessions", "stats"} {
+			if cmd.Flags().Changed(name) {
+				return fmt.Errorf("--%s has no effect with --format %s", name, format)
+			}
+		}
+		if _, err := parsePolicyCondition(policyConditionSpec); err != nil {
+			return err
+		}
+	} else if cmd.Flags().Changed("policy-condition") {
+		return fmt.Errorf("--policy-condition only applies to --format iam-policy or boundary")
+	}
+	if format == "iam-policy" {
+		if len(serviceResources) > 0 && !statementsPerService {
+			return fmt.Errorf("--service-resource sets the Resource of --statements-per-service statements")
+		}
+		if _, err := parseServiceResources(serviceResources); err != nil {
+			return err
+		}
+	} else {
+		for _, name := range []string{"split-read-write", "statements-per-service", "service-resource"} {
+			if cmd.Flags().Changed(name) {
+				return fmt.Errorf("--%s only applies to --format iam-policy", name)
+			}
+		}
+	}
+	if strings.HasPrefix(outfile, "s3://") {
+		if _, _, ok := parseS3URI(outfile); !ok {
+			return fmt.Errorf("--output %q must look like s3://bucket/key", outfile)
+		}
+	}
+	if appendOutput {
+		switch {
+		case outfile == "":
+			return fmt.Errorf("--append needs --output")
+		case strings.HasPrefix(outfile, "s3://"):
+			return fmt.Errorf("--append can't be used with an s3:// --output")
+		case policyFormat():
+			return fmt.Errorf("--append would produce an invalid policy document with --format %s", format)
+		}
+	}
+	if resourceTag != "" && !strings.Contains(resourceTag, "=") {
+		return fmt.Errorf("--resource-tag must be key=value, got %q", resourceTag)
+	}
+	if assumeRolePattern != "" && resourceTag == "" {
+		return fmt.Errorf("--assume-all-org-accounts only applies to the per-account lookups of --resource-tag")
+	}
+	if strings.HasPrefix(assumeRolePattern, "arn:") && !strings.Contains(assumeRolePattern, "{account}") {
+		return fmt.Errorf("--assume-all-org-accounts wants a role name or an ARN with an {account} placeholder, got %q", assumeRolePattern)
+	}
+	if err := parseSeverityWeights(severityWeightsSpec); err != nil {
+		return err
+	}
+	if err := compileFilter(filterExpr); err != nil {
+		return err
+	}
+	if err := parseSourceIPs(sourceIPSpecs); err != nil {
+		return err
+	}
+	files := map[string]string{}
+	for _, f := range []struct{ name, path string }{
+		{"output", outfile},
+		{"dump-events", dumpEvents},
+		{"sqlite", sqlitePath},
+		{"list-checkpoint", listCheckpointFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if other, ok := files[f.path]; ok {
+			return fmt.Errorf("--%s and --%s both point at %s", other, f.name, f.path)
+		}
+		files[f.path] = f.name
+	}
+	return nil
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	// the flags passed validation; a failure from here on isn't a usage error
+	cmd.SilenceUsage = true
+	// Banner
+	fmt.Println(`▓█████  ███▄    █ ▄▄▄█████▓ ██▀███   ▄▄▄       ██▓ ██▓      ██████ 
+▓█   ▀  ██ ▀█   █ ▓  ██▒ ▓▒▓██ ▒ ██▒▒████▄    ▓██▒▓██▒    ▒██    ▒ 
+▒███   ▓██  ▀█ ██▒▒ ▓██░ ▒░▓██ ░▄█ ▒▒██  ▀█▄  ▒██▒▒██░    ░ ▓██▄   
+▒▓█  ▄ ▓██▒  ▐▌██▒░ ▓██▓ ░ ▒██▀▀█▄  ░██▄▄▄▄██ ░██░▒██░      ▒   ██▒
+░▒████▒▒██░   ▓██░  ▒██▒ ░ ░██▓ ▒██▒ ▓█   ▓██▒░██░░██████▒▒██████▒▒
+░░ ▒░ ░░ ▒░   ▒ ▒   ▒ ░░   ░ ▒▓ ░▒▓░ ▒▒   ▓▒█░░▓  ░ ▒░▓  ░▒ ▒▓▒ ▒ ░
+ ░ ░  ░░ ░░   ░ ▒░    ░      ░▒ ░ ▒░  ▒   ▒▒ ░ ▒ ░░ ░ ▒  ░░ ░▒  ░ ░
+   ░      ░   ░ ░   ░        ░░   ░   ░   ▒    ▒ ░  ░ ░   ░  ░  ░  
+   ░  ░         ░             ░           ░  ░ ░      ░  ░      ░  
+                                                                  `)
+	var targets []shard
+	var err error
+	if keysFile == "" && !readStdin {
+		targets, err = bucketTargets(buckets, prefixes)
+		if err != nil {
+			return inStage(stageConfig, err)
+		}
+		warned := make(map[string]bool)
+		for _, t := range targets {
+			if msg := prefixWarning(t.prefix); msg != "" && !warned[t.prefix] {
+				warned[t.prefix] = true
+				fmt.Fprintf(os.Stderr, "WARNING: %s\n", msg)
+			}
+		}
+	}
+
+	var baselineActions []string
+	if baseline != "" {
+		baselineActions, err = loadPolicyActions(baseline)
+		if err != nil {
+			return inStage(stageConfig, fmt.Errorf("--baseline-policy: %w", err))
+		}
+		fmt.Printf("Loaded %d action patterns from baseline policy.\n", len(baselineActions))
+	}
+	var grantedActions []string
+	if currentPolicy != "" {
+		grantedActions, err = loadPolicyActions(currentPolicy)
+		if err != nil {
+			return inStage(stageConfig, fmt.Errorf("--current-policy: %w", err))
+		}
+		fmt.Printf("Loaded %d action patterns from current policy.\n", len(grantedActions))
+	}
+	if rulesFile != "" {
+		if err := loadRules(rulesFile); err != nil {
+			return inStage(stageConfig, fmt.Errorf("--rules: %w", err))
+		}
+		fmt.Printf("Loaded %d finding rules.\n", len(findingRules))
+	}
+
+	// Ctrl-C cancels in-flight requests instead of killing the process mid-write
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	start := time.Now()
+	stats := &scanStats{}
+	if metricsAddr != "" {
+		ms, err := startMetrics(metricsAddr, stats)
+		if err != nil {
+			return inStage(stageConfig, fmt.Errorf("--metrics-addr: %w", err))
+		}
+		defer ms.stop()
+		fmt.Printf("Serving metrics on http://%s/metrics\n", metricsAddr)
 	}
-	return arn
+
+	// --stdin needs neither credentials nor a client
+	var cfg aws.Config
+	var s3cli *s3.Client
+	if !readStdin {
+		fmt.Println("Loading AWS config...")
+		// only pin a profile when asked, so AWS_PROFILE, SSO and credential_process keep working
+		loadOpts := []func(*config.LoadOptions) error{
+			config.WithRetryer(func() aws.Retryer {
+				std := retry.NewStandard(func(o *retry.StandardOptions) { o.MaxAttempts = maxRetries + 1 })
+				return countingRetryer{std, stats}
+			}),
+		}
+		if profile != "" {
+			loadOpts = append(loadOpts, config.WithSharedConfigProfile(profile))
+		}
+		if credentialsFile != "" {
+			loadOpts = append(loadOpts, config.WithSharedCredentialsFiles([]string{credentialsFile}))
+		}
+		if configFile != "" {
+			loadOpts = append(loadOpts, config.WithSharedConfigFiles([]string{configFile}))
+		}
+		cfg, err = config.LoadDefaultConfig(ctx, loadOpts...)
+		if err != nil {
+			return inStage(stageConfig, fmt.Errorf("loading AWS config: %w", credentialError(err)))
+		}
+		// resolve credentials up front so an expired SSO session is reported clearly
+		if cfg.Credentials != nil {
+			if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+				return inStage(stageConfig, fmt.Errorf("loading AWS credentials: %w", credentialError(err)))
+			}
+		}
+
+		if identity == "" && len(compareIDs) == 0 && !listIDs {
+			fmt.Println("Retrieving caller identity...")
+			// cfg's retryer gives this call the same --max-retries backoff as S3
+			stscli := sts.NewFromConfig(cfg)
+			res, err := stscli.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+			if err != nil {
+				return inStage(stageConfig, callerIdentityError(err))
+			}
+			identity = normalizeArn(*res.Arn)
+			fmt.Printf("Using identity: %s\n", identity)
+		}
+
+		// instantiate S3 client
+		s3cli = s3.NewFromConfig(cfg, func(o *s3.Options) {
+			o.DisableLogOutputChecksumValidationSkipped = true
+			// an access point ARN names its own region, which may not be ours
+			o.UseARNRegion = true
+		})
+		outputClient = s3cli
+	}
+
+	skipped := &skipList{}
+	var allKeys []logObject
+	var ckpt *listCheckpoint
+	var listFailed int64
+	if keysFile != "" {
+		allKeys, err = readKeysFile(keysFile, buckets[0])
+		if err != nil {
+			return inStage(stageList, fmt.Errorf("--keys-file: %w", err))
+		}
+		fmt.Printf("Read %d keys from %s; skipping discovery and listing.\n", len(allKeys), keysFile)
+	} else if !readStdin {
+		allKeys, ckpt, listFailed, err = listLogObjects(ctx, s3cli, targets, skipped)
+		if err != nil {
+			return inStage(stageList, err)
+		}
+	}
+
+	total := int64(len(allKeys))
+	atomic.StoreInt64(&stats.ObjectsListed, total)
+	if !readStdin {
+		fmt.Printf("Total log files: %d\n", total)
+	}
+	if sampleRate < 1 {
+		stats.SampleRate = sampleRate
+		fmt.Printf("Sampling %.1f%% of log files by key.\n", sampleRate*100)
+	}
+
+	if estimateOnly || (confirmThreshold > 0 && total > confirmThreshold && !assumeYes) {
+		var size int64
+		for _, o := range allKeys {
+			size += aws.ToInt64(o.obj.Size)
+		}
+		fmt.Printf("Estimated download: %s in %d GET requests (%s)\n", humanBytes(size), total, costEstimate(total, size))
+		if estimateOnly {
+			return nil
+		}
+		ok, err := confirm(fmt.Sprintf("%d log files is more than --confirm-threshold %d. Proceed?", total, confirmThreshold))
+		if err != nil {
+			return inStage(stageConfig, err)
+		}
+		if !ok {
+			fmt.Println("Aborted.")
+			return nil
+		}
+	}
+
+	var dump *eventDump
+	if dumpEvents != "" {
+		dump, err = newEventDump(dumpEvents)
+		if err != nil {
+			return inStage(stageOutput, fmt.Errorf("--dump-events: %w", err))
+		}
+	}
+
+	var tags *tagFilter
+	if resourceTag != "" {
+		tags, err = newTagFilter(cfg, resourceTag)
+		if err != nil {
+			return inStage(stageConfig, err)
+		}
+		if assumeRolePattern != "" {
+			tags.roles = assumeAccountRoles(ctx, cfg, assumeRolePattern, logAccounts(allKeys))
+			stats.AssumeRoleFailures = tags.roles.failed
+		}
+	}
+
+	// process logs
+	idResults := make(map[string]*results)
+	if len(compareIDs) > 0 {
+		for _, id := range compareIDs {
+			idResults[id] = newResults()
+		}
+	} else {
+		idResults[identity] = newResults()
+	}
+	sc := &scanner{s3: s3cli, targets: idResults, stats: stats, dump: dump, tags: tags, now: time.Now(), creds: newCredRefresher(cfg)}
+	if listIDs {
+		sc.tally = &identityTally{counts: make(map[string]int64)}
+	}
+	if dedupe {
+		sc.seen = &eventSet{ids: make(map[string]struct{})}
+	}
+	if ignoreCase {
+		sc.folded = make(map[string]*results, len(idResults))
+		for id, res := range idResults {
+			sc.folded[strings.ToLower(id)] = res
+		}
+	}
+	for id := range idResults {
+		if !strings.HasPrefix(id, "arn:") {
+			sc.bare = true
+		}
+	}
+
+	// a worker that can't carry on (credentials that can't be refreshed)
+	// records why in fatal and stops the rest through abort; a plain
+	// cancellation of ctx is an interrupt, which leaves partial results
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	var fatal error
+	var fatalOnce sync.Once
+	if readStdin {
+		fmt.Println("Reading CloudTrail events from stdin...")
+		if err := sc.scanStdin(ctx); err != nil {
+			return inStage(stageDecode, err)
+		}
+	} else {
+		if threads == 0 {
+			var size int64
+			for _, o := range allKeys {
+				size += aws.ToInt64(o.obj.Size)
+			}
+			var avg int64
+			if total > 0 {
+				avg = size / total
+			}
+			threads = autoThreads(runtime.NumCPU(), avg, total)
+			fmt.Printf("Auto-selected %d workers (%d CPUs, average object %s).\n", threads, runtime.NumCPU(), humanBytes(avg))
+		}
+		fmt.Printf("Starting %d workers for log processing...\n", threads)
+		// keep the queue short: the producer blocks until the workers catch up
+		depth := queueDepth
+		if depth == 0 {
+			depth = 2 * threads
+		}
+		jobs := make(chan logObject, depth)
+		go func() {
+			defer close(jobs)
+			for _, obj := range allKeys {
+				select {
+				case jobs <- obj:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		var wg sync.WaitGroup
+		for i := 0; i < threads; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for o := range jobs {
+					if err := sc.processRecovered(ctx, o.bucket, *o.obj.Key, aws.ToInt64(o.obj.Size)); err != nil {
+						fatalOnce.Do(func() { fatal = err })
+						abort()
+					}
+					cur := atomic.AddInt64(&stats.ObjectsProcessed, 1)
+					if cur%100 == 0 || cur == total {
+						fmt.Printf("\rProcessed %d/%d logs", cur, total)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		fmt.Println()
+	}
+	if fatal != nil {
+		return fatal
+	}
+	stats.ElapsedSeconds = time.Since(start).Seconds()
+	if !readStdin {
+		fmt.Printf("Downloaded %s in %d GET requests (%s)\n", humanBytes(stats.BytesDownloaded), stats.GetRequests, costEstimate(stats.GetRequests, stats.BytesDownloaded))
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "Interrupted; results below are partial.")
+	}
+	stats.SkippedPrefixes = skipped.items
+	stats.collectVersions()
+	warnVersionDrift(os.Stderr, stats.EventVersions)
+	if stats.Throttles >= 10 && stats.Throttles*100 >= stats.GetRequests {
+		fmt.Fprintf(os.Stderr, "\nWARNING: S3 throttled %d requests (%d retries in total); consider lowering --threads.\n", stats.Throttles, stats.Retries)
+	}
+	if stats.SampleRate > 0 {
+		fmt.Fprintf(os.Stderr, "\nWARNING: only %.1f%% of log files were sampled; results are incomplete.\n", stats.SampleRate*100)
+	}
+	if len(skipped.items) > 0 {
+		fmt.Fprintf(os.Stderr, "\nWARNING: %d prefix(es) could not be listed and were skipped:\n", len(skipped.items))
+		for _, sp := range skipped.items {
+			fmt.Fprintf(os.Stderr, "- s3://%s/%s (%s)\n", sp.Bucket, sp.Prefix, sp.Reason)
+		}
+	}
+
+	if ckpt != nil {
+		if listFailed == 0 {
+			if err := ckpt.remove(); err != nil {
+				fmt.Fprintln(os.Stderr, "checkpoint error:", err)
+			}
+		} else {
+			fmt.Printf("Listing was incomplete; keeping %s so the next run can resume it.\n", listCheckpointFile)
+		}
+	}
+
+	if dump != nil {
+		if err := dump.Close(); err != nil {
+			return inStage(stageOutput, fmt.Errorf("--dump-events: %w", err))
+		}
+		fmt.Printf("Wrote matched events to %s\n", dumpEvents)
+	}
+
+	// before --baseline-policy drops actions, which were still used
+	if currentPolicy != "" {
+		res := idResults[identity]
+		res.unused = unusedPatterns(grantedActions, sortedKeys(res.actions))
+	}
+	if baseline != "" {
+		for id, res := range idResults {
+			for a := range res.actions {
+				if actionCovered(a, baselineActions) {
+					delete(res.actions, a)
+				}
+			}
+			fmt.Printf("%s: %d action(s) not covered by the baseline policy.\n", id, len(res.actions))
+		}
+	}
+
+	if sqlitePath != "" {
+		if err := writeSQLite(sqlitePath, idResults); err != nil {
+			return inStage(stageOutput, err)
+		}
+		fmt.Printf("Recorded the scan in %s\n", sqlitePath)
+	}
+
+	if listIDs {
+		return inStage(stageOutput, writeIdentities(outfile, sc.tally, stats))
+	}
+
+	if len(compareIDs) > 0 {
+		return inStage(stageOutput, writeComparison(outfile, compareIDs[0], compareIDs[1], idResults, stats))
+	}
+
+	// output
+	res := idResults[identity]
+	keysAct := sortedKeys(res.actions)
+	if topN > 0 {
+		keysAct = topActions(res, topN)
+	}
+	if outputTemplate != nil {
+		return inStage(stageOutput, writeTemplate(outfile, identity, keysAct, res, stats))
+	}
+	switch format {
+	case "iam-policy", "boundary":
+		return inStage(stageOutput, writePolicy(outfile, keysAct, res))
+	case "json":
+		return inStage(stageOutput, writeJSON(outfile, identity, keysAct, res, stats))
+	case "json-per-identity":
+		js, err := openJSONStream(outfile)
+		if err != nil {
+			return inStage(stageOutput, err)
+		}
+		js.write(newJSONReport(identity, keysAct, res))
+		js.write(struct {
+			Stats *scanStats `json:"stats"`
+		}{stats})
+		return inStage(stageOutput, js.close())
+	case "markdown":
+		return inStage(stageOutput, writeMarkdown(outfile, identity, keysAct, res, stats))
+	case "table":
+		return inStage(stageOutput, writeTable(outfile, identity, keysAct, res, stats))
+	case "matrix-csv":
+		return inStage(stageOutput, writeMatrixCSV(outfile, keysAct, res))
+	}
+	fmt.Println()
+	if outfile == "" {
+		writeText(redactWriter{os.Stdout}, identity, keysAct, res, stats)
+		return nil
+	}
+	// render once so the file and the terminal can't disagree
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	if !quiet {
+		w = io.MultiWriter(os.Stdout, &buf)
+	}
+	writeText(redactWriter{w}, identity, keysAct, res, stats)
+	if err := saveOutput(outfile, buf.Bytes()); err != nil {
+		return inStage(stageOutput, err)
+	}
+	fmt.Println("Finished writing output.")
+	return nil
+}
+
+// results holds everything aggregated for one target identity
+type results struct {
+	mu      sync.Mutex
+	actions map[string]*actionStat
+	secrets map[string]string // secret name -> most specific reference seen
+	// earliest and latest matched eventTime
+	first, last time.Time
+	sourceIPs   map[string]struct{}
+	userAgents  map[string]struct{}
+	// assumed-role session name -> events, with --show-sessions
+	sessions map[string]int64
+	// action -> events by outcome, failed ones included, with --count-attempts
+	attempts map[string]attemptStat
+	// actions that touched a resource owned by another account
+	crossAccount map[string]struct{}
+	// events dated after the scan started (beyond --clock-skew)
+	future []futureEvent
+	// bytesTransferredOut over all matched events
+	bytesOut int64
+	// distinct resource ARNs from matched events, with --list-resources
+	resources map[string]struct{}
+	// event counts by action for service-linked roles, kept out of actions
+	slrActions map[string]int64
+	// --current-policy action patterns that no matched event used
+	unused []string
+	// day (UTC, YYYY-MM-DD) -> action -> events, with --group-by-date
+	days map[string]map[string]int64
+	// readMinute -> read-only actions called in it, for reconBursts
+	reads map[int64]map[string]struct{}
+	// action -> events outside --business-hours
+	offHours map[string]int64
+}
+
+// unknownDay groups events whose eventTime couldn't be parsed
+const unknownDay = "unknown date"
+
+// dayActivity is what an identity did on one day
+type dayActivity struct {
+	Date    string      `json:"date"`
+	Actions []dayAction `json:"actions"`
+}
+
+type dayAction struct {
+	Action string `json:"action"`
+	Count  int64  `json:"count"`
+}
+
+// dayList returns the --group-by-date log in date order, keeping only the
+// actions in keys so --top-n applies to it as well
+func (r *results) dayList(keys []string) []dayActivity {
+	var out []dayActivity
+	for _, day := range sortedKeys(r.days) {
+		d := dayActivity{Date: day}
+		for _, a := range keys {
+			if n := r.days[day][a]; n > 0 {
+				d.Actions = append(d.Actions, dayAction{Action: a, Count: n})
+			}
+		}
+		if len(d.Actions) > 0 {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// futureEvent is a matched event whose eventTime lies in the future, a sign of
+// tampering or a badly skewed clock
+type futureEvent struct {
+	Action    string `json:"action"`
+	EventTime string `json:"eventTime"`
+	EventID   string `json:"eventId,omitempty"`
+}
+
+// futureList returns the future-dated events in eventTime order
+func (r *results) futureList() []futureEvent {
+	out := slices.Clone(r.future)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].EventTime != out[j].EventTime {
+			return out[i].EventTime < out[j].EventTime
+		}
+		return out[i].EventID < out[j].EventID
+	})
+	return out
+}
+
+// topActions returns the n most frequent actions, most frequent first
+func topActions(res *results, n int) []string {
+	keys := sortedKeys(res.actions)
+	sort.SliceStable(keys, func(i, j int) bool { return res.actions[keys[i]].Count > res.actions[keys[j]].Count })
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// findings classifies every action the identity performed, so --top-n
+// never hides a finding
+func (r *results) findings() []finding {
+	return classify(sortedKeys(r.actions), r)
+}
+
+// activeSpan summarises when the identity was active, or "" if nothing matched
+func (r *results) activeSpan() string {
+	if r.first.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("Active from %s to %s", r.first.Format(time.RFC3339), r.last.Format(time.RFC3339))
+}
+
+// eventRefsPerAction caps the events listed per action in json output, so a
+// long scan's memory grows with its distinct actions rather than its events
+const eventRefsPerAction = 100
+
+// actionStat tracks how often, when and where an action was seen. Events is
+// only filled for json output, the one place it's reported, with the first
+// eventRefsPerAction events; MoreEvents counts the ones left off.
+type actionStat struct {
+	Count int64
+	// UTC RFC 3339 times, or the raw eventTime when it couldn't be parsed
+	FirstSeen   string
+	LastSeen    string
+	first, last time.Time
+	Regions     map[string]int64 // awsRegion -> events
+	Accounts    map[string]int64 // recipientAccountId -> events
+	Events      []eventRef
+	MoreEvents  int64
+	// bytesTransferredOut summed over the action's events
+	BytesOut int64
+	// the earliest event behind the action, with --explain
+	example *exampleEvent
+	// resource ARNs its events touched, with --format boundary; anyResource
+	// is set once an event named none, so only * covers it
+	resources   map[string]struct{}
+	anyResource bool
+	// seen in at least one API call, not only console sign-in or service events
+	apiCall bool
+}
+
+// seen widens the first/last seen window to include an event. Events are
+// ordered by their parsed time; raw strings are only compared when nothing
+// parsed, as a last resort.
+func (st *actionStat) seen(raw string, t time.Time, ok bool) {
+	if !ok {
+		if st.first.IsZero() && (st.FirstSeen == "" || raw < st.FirstSeen) {
+			st.FirstSeen = raw
+		}
+		if st.last.IsZero() && raw > st.LastSeen {
+			st.LastSeen = raw
+		}
+		return
+	}
+	if st.first.IsZero() || t.Before(st.first) {
+		st.first = t
+		st.FirstSeen = t.Format(time.RFC3339Nano)
+	}
+	if t.After(st.last) {
+		st.last = t
+		st.LastSeen = t.Format(time.RFC3339Nano)
+	}
+}
+
+// exampleEvent is the event --explain shows for an action
+type exampleEvent struct {
+	EventID   string
+	EventTime string
+	SourceIP  string
+	Raw       json.RawMessage
+	at        time.Time
+}
+
+// offerExample keeps the earliest event of the action as its example, so the
+// pick doesn't depend on the order workers finish in. Like seen, it only
+// falls back to an event with an unusable time while there's nothing better.
+func (st *actionStat) offerExample(raw json.RawMessage, id, eventTime, sourceIP string, t time.Time, ok bool) {
+	if ex := st.example; ex != nil {
+		switch {
+		case !ok && (!ex.at.IsZero() || id >= ex.EventID):
+			return
+		case ok && !ex.at.IsZero() && (t.After(ex.at) || t.Equal(ex.at) && id >= ex.EventID):
+			return
+		}
+	}
+	var b bytes.Buffer
+	if json.Compact(&b, raw) != nil {
+		return
+	}
+	ex := &exampleEvent{EventID: id, EventTime: eventTime, SourceIP: sourceIP, Raw: b.Bytes()}
+	if ok {
+		ex.at = t
+	}
+	st.example = ex
+}
+
+// summary names the example event in a line
+func (ex *exampleEvent) summary() string {
+	if ex == nil {
+		return "-"
+	}
+	s := "event"
+	if ex.EventID != "" {
+		s += " " + ex.EventID
+	}
+	s += " at " + ex.EventTime
+	if ex.SourceIP != "" {
+		s += " from " + ex.SourceIP
+	}
+	return s
+}
+
+// eventTimeLayouts are the eventTime spellings we accept: CloudTrail's own
+// (with or without fractional seconds or an offset) and CloudTrail Lake's
+var eventTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999"}
+
+// parseEventTime parses an eventTime and normalizes it to UTC
+func parseEventTime(s string) (time.Time, bool) {
+	for _, layout := range eventTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// eventRef identifies a matched event for correlating with other tooling or
+// AWS Support
+type eventRef struct {
+	EventID   string `json:"eventId"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+func newResults() *results {
+	return &results{
+		actions:    make(map[string]*actionStat),
+		secrets:    make(map[string]string),
+		sourceIPs:  make(map[string]struct{}),
+		userAgents: make(map[string]struct{}),
+		sessions:   make(map[string]int64),
+		attempts:   make(map[string]attemptStat),
+
+		crossAccount: make(map[string]struct{}),
+		slrActions:   make(map[string]int64),
+		resources:    make(map[string]struct{}),
+		days:         make(map[string]map[string]int64),
+		reads:        make(map[int64]map[string]struct{}),
+		offHours:     make(map[string]int64),
+	}
+}
+
+// credentialError turns an expired or missing SSO session into an actionable message
+func credentialError(err error) error {
+	var tokErr *ssocreds.InvalidTokenError
+	msg := err.Error()
+	if !errors.As(err, &tokErr) && !strings.Contains(msg, "SSO token") && !strings.Contains(msg, "SSO session") {
+		return err
+	}
+	p := profile
+	if p == "" {
+		p = os.Getenv("AWS_PROFILE")
+	}
+	login := "aws sso login"
+	if p != "" {
+		login += " --profile " + p
+	}
+	return fmt.Errorf("SSO session expired, run `%s` and try again (%w)", login, err)
+}
+
+// shard is a bucket/prefix pair listed independently
+type shard struct {
+	bucket string
+	prefix string
+}
+
+// logObject is a listed log file along with the bucket it lives in
+type logObject struct {
+	bucket string
+	obj    types.Object
+}
+
+// listLogObjects discovers shards under each bucket target and lists them in
+// parallel. Prefixes that can't be listed are added to skipped; failed counts
+// shards whose listing broke off part way. With --on-error fail the first
+// such prefix ends the listing with an error instead.
+func listLogObjects(ctx context.Context, cli *s3.Client, targets []shard, skipped *skipList) (allKeys []logObject, ckpt *listCheckpoint, listFailed int64, err error) {
+	// discover shard prefixes
+	var shards []shard
+	for _, t := range targets {
+		fmt.Printf("Discovering shard prefixes in %s...\n", t.bucket)
+		levels, err := discoveryDepth(ctx, cli, t.bucket, t.prefix)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("detecting the layout of s3://%s/%s: %w", t.bucket, t.prefix, err)
+		}
+		found, denied, err := getShardPrefixes(ctx, cli, t.bucket, t.prefix, levels)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("discovering shards in s3://%s/%s: %w", t.bucket, t.prefix, err)
+		}
+		if onError == "fail" && len(denied) > 0 {
+			return nil, nil, 0, listAborted(denied[0])
+		}
+		skipped.add(denied...)
+		if len(found) == 0 && len(denied) > 0 {
+			fmt.Printf("No accessible prefixes under %s.\n", t.prefix)
+			continue
+		}
+		if len(found) > 1 || len(denied) > 0 {
+			fmt.Printf("Found %d shard prefixes.\n", len(found))
+		} else {
+			fmt.Println("Single shard detected or no deeper prefixes.")
+			// a lone year folder stays as found so it can still be narrowed
+			if len(found) == 0 {
+				found = []string{t.prefix}
+			}
+		}
+		for _, p := range found {
+			shards = append(shards, shard{bucket: t.bucket, prefix: p})
+		}
+	}
+	if !firstDay.IsZero() {
+		shards = narrowToWindow(shards)
+	}
+	nShards := len(shards)
+
+	if listCheckpointFile != "" {
+		ckpt, err = openListCheckpoint(listCheckpointFile)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("--list-checkpoint: %w", err)
+		}
+	}
+
+	// parallel listing; with --on-error fail, the first failed shard records
+	// why in aborted and cancels the others
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var aborted error
+	var abortOnce sync.Once
+	var shardCount int64
+	var lm sync.Mutex
+	var lwg sync.WaitGroup
+	fmt.Printf("Listing shards: 0/%d completed...\n", nShards)
+	listShard := func(sh shard) {
+		// with --recent-per-shard, only the newest keys are kept: S3 lists in
+		// key order, which is time order within a CloudTrail prefix
+		var recent []types.Object
+		if recentPerShard > 0 {
+			defer func() {
+				lm.Lock()
+				defer lm.Unlock()
+				for _, obj := range recent {
+					allKeys = append(allKeys, logObject{bucket: sh.bucket, obj: obj})
+				}
+			}()
+		}
+		add := func(objs []types.Object) {
+			if recentPerShard > 0 {
+				for _, obj := range objs {
+					if keyAllowed(*obj.Key) && regionAllowed(*obj.Key) && inWindow(*obj.Key) && inSample(*obj.Key) {
+						recent = append(recent, obj)
+					}
+				}
+				if len(recent) > recentPerShard {
+					recent = slices.Clone(recent[len(recent)-recentPerShard:])
+				}
+				return
+			}
+			lm.Lock()
+			defer lm.Unlock()
+			for _, obj := range objs {
+				if !keyAllowed(*obj.Key) || !regionAllowed(*obj.Key) || !inWindow(*obj.Key) || !inSample(*obj.Key) {
+					continue
+				}
+				allKeys = append(allKeys, logObject{bucket: sh.bucket, obj: obj})
+			}
+		}
+		input := &s3.ListObjectsV2Input{Bucket: aws.String(sh.bucket), Prefix: aws.String(sh.prefix)}
+		if sp := ckpt.resume(sh); sp != nil {
+			add(sp.objects)
+			if sp.done {
+				cur := atomic.AddInt64(&shardCount, 1)
+				fmt.Printf("\rListing shards: %d/%d completed", cur, nShards)
+				return
+			}
+			input.ContinuationToken = aws.String(sp.token)
+		}
+		paginator := s3.NewListObjectsV2Paginator(cli, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					// interrupted, or stopped by another shard's failure;
+					// counted as unfinished below
+					return
+				}
+				sp := skippedPrefix{Bucket: sh.bucket, Prefix: sh.prefix, Reason: listErrorReason(err)}
+				if onError == "fail" {
+					abortOnce.Do(func() { aborted = listAborted(sp) })
+					cancel()
+					return
+				}
+				fmt.Fprintf(os.Stderr, "\nlist error for s3://%s/%s: %v\n", sh.bucket, sh.prefix, err)
+				skipped.add(sp)
+				atomic.AddInt64(&listFailed, 1)
+				return
+			}
+			add(page.Contents)
+			if ckpt != nil {
+				if err := ckpt.record(sh, page); err != nil {
+					fmt.Fprintln(os.Stderr, "checkpoint error:", err)
+				}
+			}
+		}
+		cur := atomic.AddInt64(&shardCount, 1)
+		fmt.Printf("\rListing shards: %d/%d completed", cur, nShards)
+	}
+	// a fixed pool: wide buckets have hundreds of shards, and a paginator
+	// for each at once gets S3 to throttle
+	queue := make(chan shard)
+	for i := 0; i < min(listThreads, nShards); i++ {
+		lwg.Add(1)
+		go func() {
+			defer lwg.Done()
+			for sh := range queue {
+				listShard(sh)
+			}
+		}()
+	}
+	for _, sh := range shards {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- sh
+	}
+	close(queue)
+	lwg.Wait()
+	fmt.Println()
+	if aborted != nil {
+		return nil, ckpt, 0, aborted
+	}
+	if ctx.Err() != nil && shardCount < int64(nShards) {
+		// every shard that didn't finish, so the checkpoint is kept
+		listFailed = int64(nShards) - shardCount
+		fmt.Fprintf(os.Stderr, "Interrupted; listing is incomplete (%d of %d shard prefixes not finished).\n", listFailed, nShards)
+	}
+	return allKeys, ckpt, listFailed, nil
+}
+
+// narrowToWindow replaces each <region>/<year>/ shard with the month and day
+// folders of the --start-time window, so listing doesn't page through days that
+// can't matter. Shards of layouts it doesn't recognize stay whole and are
+// only filtered by the dates in their keys.
+func narrowToWindow(shards []shard) []shard {
+	var out []shard
+	narrowed := 0
+	for _, sh := range shards {
+		days, ok := datePrefixes(sh.prefix)
+		if !ok {
+			out = append(out, sh)
+			continue
+		}
+		narrowed++
+		for _, d := range days {
+			out = append(out, shard{bucket: sh.bucket, prefix: d})
+		}
+	}
+	fmt.Printf("Time window %s to %s: narrowed %d of %d shard prefixes to %d date prefixes.\n",
+		firstDay.Format(time.DateOnly), lastDay.Format(time.DateOnly), narrowed, len(shards), len(out)-(len(shards)-narrowed))
+	return out
+}
+
+// listAborted is the error --on-error fail ends the scan with
+func listAborted(sp skippedPrefix) error {
+	return fmt.Errorf("can't list s3://%s/%s (%s); stopping because of --on-error fail", sp.Bucket, sp.Prefix, sp.Reason)
+}
+
+// readKeysFile loads the objects named in file, one per line, either as
+// s3://bucket/key or as a bare key in bucket. Blank lines and # comments are
+// skipped.
+func readKeysFile(file, bucket string) ([]logObject, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var objs []logObject
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b, key := bucket, line
+		if strings.HasPrefix(line, "s3://") {
+			var ok bool
+			if b, key, ok = parseS3URI(line); !ok {
+				return nil, fmt.Errorf("%s:%d: bad S3 URI %q", file, i+1, line)
+			}
+		}
+		objs = append(objs, logObject{bucket: b, obj: types.Object{Key: aws.String(key)}})
+	}
+	return objs, nil
+}
+
+// bucketTargets pairs each --bucket with its --prefix; a single prefix is
+// shared by every bucket
+func bucketTargets(buckets, prefixes []string) ([]shard, error) {
+	if len(buckets) == 0 || len(prefixes) == 0 {
+		return nil, fmt.Errorf("--bucket and --prefix are required")
+	}
+	if len(prefixes) != 1 && len(prefixes) != len(buckets) {
+		return nil, fmt.Errorf("got %d buckets but %d prefixes; pass one prefix per bucket or a single shared prefix", len(buckets), len(prefixes))
+	}
+	targets := make([]shard, len(buckets))
+	for i, b := range buckets {
+		if err := checkAccessPoint(b); err != nil {
+			return nil, err
+		}
+		p := prefixes[0]
+		if len(prefixes) > 1 {
+			p = prefixes[i]
+		}
+		targets[i] = shard{bucket: b, prefix: p}
+	}
+	return targets, nil
+}
+
+// checkAccessPoint vets a --bucket given as an ARN. The SDK takes S3 and
+// S3 Object Lambda access point ARNs wherever a bucket name goes; a
+// multi-Region access point would need SigV4A signing, which isn't built in.
+func checkAccessPoint(bucket string) error {
+	if !arn.IsARN(bucket) {
+		return nil
+	}
+	a, err := arn.Parse(bucket)
+	if err != nil {
+		return fmt.Errorf("--bucket %s: %w", bucket, err)
+	}
+	kind, name, _ := strings.Cut(a.Resource, "/")
+	if (a.Service != "s3" && a.Service != "s3-object-lambda") || kind != "accesspoint" || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("--bucket takes a bucket name or an access point ARN (arn:aws:s3:<region>:<account>:accesspoint/<name>), got %s", bucket)
+	}
+	if a.Region == "" {
+		return fmt.Errorf("--bucket %s: multi-Region access points aren't supported; use a regional access point or the bucket", bucket)
+	}
+	return nil
+}
+
+// accountIDRe matches a 12-digit AWS account ID
+var accountIDRe = regexp.MustCompile(`^[0-9]{12}$`)
+
+// prefixWarning returns a heads-up when prefix sits above the CloudTrail
+// directory. Other services (ELB access logs, VPC flow logs, ...) write under
+// AWSLogs/ too, and their files would be downloaded and parsed for nothing.
+func prefixWarning(prefix string) string {
+	if strings.Contains(prefix, "CloudTrail") {
+		return ""
+	}
+	want := "AWSLogs/<account-id>/CloudTrail/"
+	segs := strings.Split(strings.TrimSuffix(prefix, "/"), "/")
+	if root := slices.Index(segs, "AWSLogs"); root >= 0 {
+		below := segs[root+1:]
+		if len(below) > 0 && orgIDRe.MatchString(below[0]) {
+			want = "AWSLogs/" + below[0] + "/<account-id>/CloudTrail/"
+			below = below[1:]
+		}
+		if len(below) == 1 && accountIDRe.MatchString(below[0]) {
+			want = strings.Join(segs, "/") + "/CloudTrail/"
+		}
+	}
+	return fmt.Sprintf("prefix %q doesn't include CloudTrail/ and may also sweep in other services' logs (ELB, VPC flow logs, ...), making the scan slower; consider --prefix %s", prefix, want)
+}
+
+// confirm asks a yes/no question on the terminal. Without a terminal there's
+// nobody to ask, so it fails with a pointer to --yes rather than guessing.
+func confirm(question string) (bool, error) {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false, fmt.Errorf("%s\nstdin isn't a terminal; pass --yes to proceed without confirmation", question)
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// keyAllowed applies --key-include and --key-exclude; * in a glob also spans '/'
+func keyAllowed(key string) bool {
+	if len(keyInclude) > 0 {
+		matched := false
+		for _, g := range keyInclude {
+			if wildcardMatch(g, key) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, g := range keyExclude {
+		if wildcardMatch(g, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// regionSegRe matches a region folder in a trail's keys
+var regionSegRe = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// regionAllowed applies --regions to a key or prefix by its first region
+// folder. Paths without one, above the region level or in a custom layout,
+// pass so discovery can descend into them.
+func regionAllowed(path string) bool {
+	if len(trailRegions) == 0 {
+		return true
+	}
+	for _, seg := range strings.Split(path, "/") {
+		if regionSegRe.MatchString(seg) {
+			return slices.Contains(trailRegions, seg)
+		}
+	}
+	return true
+}
+
+// inSample reports whether key falls in the --sample-rate fraction. Hashing
+// the key keeps the choice stable, so repeat runs sample the same objects.
+func inSample(key string) bool {
+	if sampleRate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return float64(h.Sum64())/math.MaxUint64 < sampleRate
+}
+
+// skippedPrefix is a prefix we weren't able to list
+type skippedPrefix struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	Reason string `json:"reason"`
+}
+
+type skipList struct {
+	mu    sync.Mutex
+	items []skippedPrefix
+}
+
+func (l *skipList) add(items ...skippedPrefix) {
+	l.mu.Lock()
+	l.items = append(l.items, items...)
+	l.mu.Unlock()
 }
 
-func main() {
-	root := &cobra.Command{
-		Use:   "cloudtrail2iam",
-		Short: "Analyze CloudTrail logs for successful actions by identity",
-		Run:   run,
+// listErrorReason classifies a listing failure for the skipped-prefix report
+func listErrorReason(err error) string {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "AccessDenied":
+			return "access denied"
+		case "NoSuchBucket":
+			return "no such bucket"
+		}
+		return ae.ErrorCode()
 	}
+	return err.Error()
+}
 
-	root.Flags().StringVar(&bucket, "bucket", "", "S3 bucket name (e.g. AWSLogs/<acc-id>/CloudTrail/)")
-	root.Flags().StringVar(&prefix, "prefix", "", "S3 prefix for CloudTrail logs")
-	root.Flags().StringVar(&profile, "profile", "", "AWS CLI profile to use")
-	root.Flags().IntVar(&threads, "threads", 10, "Number of workers for listing shards and processing logs")
-	root.Flags().StringVar(&identity, "identity", "", "Filter by identity ARN (default: caller identity)")
-	root.Flags().StringVar(&outfile, "output", "", "Write results to this file (optional)")
-	root.MarkFlagRequired("bucket")
-	root.MarkFlagRequired("prefix")
+// bounds for --threads auto
+const (
+	minAutoThreads = 4
+	maxAutoThreads = 64
+)
 
-	if err := root.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+// autoThreads sizes the worker pool for --threads auto. Small log files keep
+// workers waiting on GetObject round trips, so they get plenty of workers per
+// CPU; large ones are dominated by gunzip and JSON decoding, which can't use
+// more than a few per CPU. The result is clamped to [minAutoThreads,
+// maxAutoThreads] and never exceeds the number of objects.
+func autoThreads(cpus int, avgSize, objects int64) int {
+	perCPU := 8
+	switch {
+	case avgSize >= 8<<20:
+		perCPU = 2
+	case avgSize >= 1<<20:
+		perCPU = 4
 	}
+	n := min(max(cpus*perCPU, minAutoThreads), maxAutoThreads)
+	if objects > 0 && int64(n) > objects {
+		n = int(objects)
+	}
+	return n
 }
 
-func run(cmd *cobra.Command, args []string) {
-	// Banner
-	fmt.Println(`▓█████  ███▄    █ ▄▄▄█████▓ ██▀███   ▄▄▄       ██▓ ██▓      ██████ 
-▓█   ▀  ██ ▀█   █ ▓  ██▒ ▓▒▓██ ▒ ██▒▒████▄    ▓██▒▓██▒    ▒██    ▒ 
-▒███   ▓██  ▀█ ██▒▒ ▓██░ ▒░▓██ ░▄█ ▒▒██  ▀█▄  ▒██▒▒██░    ░ ▓██▄   
-▒▓█  ▄ ▓██▒  ▐▌██▒░ ▓██▓ ░ ▒██▀▀█▄  ░██▄▄▄▄██ ░██░▒██░      ▒   ██▒
-░▒████▒▒██░   ▓██░  ▒██▒ ░ ░██▓ ▒██▒ ▓█   ▓██▒░██░░██████▒▒██████▒▒
-░░ ▒░ ░░ ▒░   ▒ ▒   ▒ ░░   ░ ▒▓ ░▒▓░ ▒▒   ▓▒█░░▓  ░ ▒░▓  ░▒ ▒▓▒ ▒ ░
- ░ ░  ░░ ░░   ░ ▒░    ░      ░▒ ░ ▒░  ▒   ▒▒ ░ ▒ ░░ ░ ▒  ░░ ░▒  ░ ░
-   ░      ░   ░ ░   ░        ░░   ░   ░   ▒    ▒ ░  ░ ░   ░  ░  ░  
-   ░  ░         ░             ░           ░  ░ ░      ░  ░      ░  
-                                                                  `)
-	ctx := context.Background()
+// orgIDRe matches an AWS Organizations ID, the extra path segment org
+// trails add under AWSLogs/
+var orgIDRe = regexp.MustCompile(`^o-[a-z0-9]{10,32}$`)
 
-	fmt.Println("Loading AWS config...")
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile(profile))
-	if err != nil {
-		fail(err)
+// discoveryDepth decides how many levels getShardPrefixes descends at most
+// below base. Account trails write AWSLogs/<account>/CloudTrail/<region>/<year>/...
+// and org trails put AWSLogs/<org-id>/ in front of that, so the year level
+// sits one deeper. With --layout auto the segment after AWSLogs/ decides;
+// when base stops at AWSLogs/ we peek at its first child. With a time window
+// discovery stops at the year folders, whatever base is, and narrowToWindow
+// picks the window's months and days out of them.
+func discoveryDepth(ctx context.Context, cli s3.ListObjectsV2APIClient, bucket, base string) (int, error) {
+	const minLevels = 4
+	if delimiter != "/" {
+		// a custom layout; leaf detection in getShardPrefixes finds its depth
+		return minLevels, nil
+	}
+	segs := strings.Split(strings.TrimSuffix(base, "/"), "/")
+	root := slices.Index(segs, "AWSLogs")
+	if root < 0 {
+		if layout == "org" {
+			return minLevels + 1, nil
+		}
+		return minLevels, nil
 	}
+	below := segs[root+1:]
 
-	if identity == "" {
-		fmt.Println("Retrieving caller identity...")
-		stscli := sts.NewFromConfig(cfg)
-		res, err := stscli.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
-		if err != nil {
-			fail(err)
+	org := layout == "org"
+	if layout == "auto" {
+		if len(below) > 0 {
+			org = orgIDRe.MatchString(below[0])
+		} else {
+			resp, err := cli.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(base), Delimiter: aws.String("/"), MaxKeys: aws.Int32(1)})
+			if err != nil {
+				if ctx.Err() != nil {
+					return 0, ctx.Err()
+				}
+				// discovery will hit the same error and report it as skipped
+				return minLevels, nil
+			}
+			if len(resp.CommonPrefixes) > 0 {
+				child := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(resp.CommonPrefixes[0].Prefix), base), "/")
+				org = orgIDRe.MatchString(child)
+			}
+		}
+		if org {
+			fmt.Println("Detected organization trail layout.")
 		}
-		identity = normalizeArn(*res.Arn)
-		fmt.Printf("Using identity: %s\n", identity)
 	}
 
-	// instantiate S3 client
-	s3cli := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.DisableLogOutputChecksumValidationSkipped = true
-	})
+	// segments from AWSLogs/ down to the year directory
+	want := 4
+	if org {
+		want = 5
+	}
+	if !firstDay.IsZero() {
+		return max(want-len(below), 0), nil
+	}
+	return max(want-len(below), minLevels), nil
+}
 
-	// discover shard prefixes
-	fmt.Println("Discovering shard prefixes...")
-	prefixes := getShardPrefixes(ctx, s3cli, bucket, prefix, 4)
-	nShards := len(prefixes)
-	if nShards > 1 {
-		fmt.Printf("Found %d shard prefixes.\n", nShards)
-	} else {
-		fmt.Println("Single shard detected or no deeper prefixes.")
-		prefixes = []string{prefix}
-		nShards = 1
+// getShardPrefixes walks the tree below base breadth-first, listing each level
+// concurrently and going at most 'levels' deep. A prefix that directly holds
+// objects is a leaf and is returned without descending further, so shallow
+// and deep layouts both end up fully covered. Prefixes that can't be listed
+// are skipped and returned separately so partial access still yields the
+// rest of the tree.
+func getShardPrefixes(ctx context.Context, cli s3.ListObjectsV2APIClient, bucket, base string, levels int) ([]string, []skippedPrefix, error) {
+	type listing struct {
+		children []string
+		leaf     bool
+		err      error
 	}
+	var shards []string
+	var skipped []skippedPrefix
+	frontier := []string{base}
+	for lvl := 0; lvl < levels && len(frontier) > 0; lvl++ {
+		out := make([]listing, len(frontier))
+		sem := make(chan struct{}, listThreads)
+		var wg sync.WaitGroup
+		for i, p := range frontier {
+			if ctx.Err() != nil {
+				break
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				// a wide level (hundreds of accounts or regions) can spill past
+				// one page of common prefixes
+				paginator := s3.NewListObjectsV2Paginator(cli, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(p), Delimiter: aws.String(delimiter)})
+				for paginator.HasMorePages() {
+					resp, err := paginator.NextPage(ctx)
+					if err != nil {
+						out[i].err = err
+						return
+					}
+					if len(resp.Contents) > 0 {
+						out[i].leaf = true
+					}
+					for _, cp := range resp.CommonPrefixes {
+						out[i].children = append(out[i].children, aws.ToString(cp.Prefix))
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
 
-	// parallel listing
-	var shardCount int64
-	var allKeys []types.Object
-	var lm sync.Mutex
-	var lwg sync.WaitGroup
-	fmt.Printf("Listing shards: 0/%d completed...\n", nShards)
-	for _, p := range prefixes {
-		lwg.Add(1)
-		go func(pref string) {
-			defer lwg.Done()
-			paginator := s3.NewListObjectsV2Paginator(s3cli, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(pref)})
-			for paginator.HasMorePages() {
-				page, err := paginator.NextPage(ctx)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "list error:", err)
-					return
+		var next []string
+		for i, l := range out {
+			switch {
+			case l.err != nil:
+				skipped = append(skipped, skippedPrefix{Bucket: bucket, Prefix: frontier[i], Reason: listErrorReason(l.err)})
+			case l.leaf || len(l.children) == 0:
+				shards = append(shards, frontier[i])
+			default:
+				for _, c := range l.children {
+					if regionAllowed(c) {
+						next = append(next, c)
+					}
 				}
-				lm.Lock()
-				allKeys = append(allKeys, page.Contents...)
-				lm.Unlock()
 			}
-			cur := atomic.AddInt64(&shardCount, 1)
-			fmt.Printf("\rListing shards: %d/%d completed", cur, nShards)
-		}(p)
+		}
+		frontier = next
 	}
-	lwg.Wait()
-	fmt.Println()
+	return append(shards, frontier...), skipped, nil
+}
 
-	total := int64(len(allKeys))
-	fmt.Printf("Total log files: %d\n", total)
+func sortedKeys[V any](m map[string]V) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
 
-	// process logs
-	var processed int64
-	actions := make(map[string]string)
-	var mu sync.Mutex
-	secrets := make(map[string]struct{})
+// scanner carries what every worker needs to process a log object
+type scanner struct {
+	s3      objectGetter
+	targets map[string]*results // keyed by normalized identity ARN
+	stats   *scanStats
+	dump    *eventDump
+	tags    *tagFilter
+	tally   *identityTally      // set in --list-identities mode instead of filtering
+	seen    *eventSet           // set with --dedupe
+	folded  map[string]*results // targets keyed by lowercased ARN, with --ignore-case
+	bare    bool                // some target is a bare user/<name> or role/<name>
+	now     time.Time           // reference for spotting future-dated events
+	creds   *credRefresher
+}
 
-	fmt.Printf("Starting %d workers for log processing...\n", threads)
-	jobs := make(chan types.Object, total)
-	for _, obj := range allKeys {
-		jobs <- obj
+// target finds the results an event's normalized identity ARN feeds into
+func (sc *scanner) target(arn string) (*results, bool) {
+	m := sc.targets
+	if sc.folded != nil {
+		m, arn = sc.folded, strings.ToLower(arn)
 	}
-	close(jobs)
+	if res, ok := m[arn]; ok {
+		return res, true
+	}
+	if sc.bare {
+		res, ok := m[arnResource(arn)]
+		return res, ok
+	}
+	return nil, false
+}
 
-	var wg sync.WaitGroup
-	for i := 0; i < threads; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for obj := range jobs {
-				process(ctx, s3cli, bucket, *obj.Key, identity, actions, &mu, secrets)
-				cur := atomic.AddInt64(&processed, 1)
-				if cur%100 == 0 || cur == total {
-					fmt.Printf("\rProcessed %d/%d logs", cur, total)
-				}
-			}
-		}()
+// eventSet remembers event IDs so events delivered by several trails are
+// only counted once
+type eventSet struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
+}
+
+// firstSighting records id and reports whether it hadn't been seen before.
+// Events without an ID can't be deduplicated and always count.
+func (s *eventSet) firstSighting(id string) bool {
+	if id == "" {
+		return true
 	}
-	wg.Wait()
-	fmt.Println()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, dup := s.ids[id]; dup {
+		return false
+	}
+	s.ids[id] = struct{}{}
+	return true
+}
 
-	// output
-	keysAct := sortedKeys(actions)
-	fmt.Printf("\nActions by %s:\n", identity)
-	for _, a := range keysAct {
-		fmt.Printf("- %s (%s)\n", a, actions[a])
+// identityTally counts events per normalized identity for discovery
+type identityTally struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// countingRetryer tallies retries and throttling responses for the scan
+// summary, leaving the retry decisions to the wrapped retryer
+type countingRetryer struct {
+	aws.RetryerV2
+	stats *scanStats
+}
+
+var isThrottle = retry.IsErrorThrottles(retry.DefaultThrottles)
+
+// RetryDelay is only called once the retryer has decided to retry
+func (r countingRetryer) RetryDelay(attempt int, err error) (time.Duration, error) {
+	atomic.AddInt64(&r.stats.Retries, 1)
+	if isThrottle.IsErrorThrottle(err) == aws.TrueTernary {
+		atomic.AddInt64(&r.stats.Throttles, 1)
+	}
+	return r.RetryerV2.RetryDelay(attempt, err)
+}
+
+// drainClose reads whatever is left of a response body before closing it.
+// Bailing out of a decode early otherwise leaves unread bytes on the
+// connection and the HTTP client can't reuse it.
+func drainClose(body io.ReadCloser) {
+	io.Copy(io.Discard, body)
+	body.Close()
+}
+
+// process downloads and scans one log object. Objects that can't be fetched
+// or decoded are counted and skipped; the error it returns means the scan
+// can't go on at all.
+func (sc *scanner) process(ctx context.Context, bucket, key string, size int64) error {
+	stats := sc.stats
+	if rangedThreshold > 0 && size > rangedThreshold {
+		rb := sc.getRanged(ctx, bucket, key, size)
+		sc.scanObject(ctx, bucket, key, rb)
+		rb.Close()
+		return rb.fatal
+	}
+	r, err := sc.get(ctx, bucket, key, "")
+	var se *stageError
+	if errors.As(err, &se) {
+		return err
+	} else if err != nil {
+		atomic.AddInt64(&stats.ObjectsFailed, 1)
+		return nil
+	}
+	defer drainClose(r.Body)
+	sc.scanObject(ctx, bucket, key, r.Body)
+	return nil
+}
+
+// scanObject scans a fetched object's body, counting it as partly decoded
+// or failed when it goes wrong
+func (sc *scanner) scanObject(ctx context.Context, bucket, key string, body io.Reader) {
+	stats := sc.stats
+	if n, err := sc.scan(ctx, body); err != nil && n > 0 {
+		fmt.Fprintf(os.Stderr, "\nWarning: s3://%s/%s %s\n", bucket, key, sc.partial(n, err))
+	} else if err != nil {
+		atomic.AddInt64(&stats.ObjectsFailed, 1)
+	}
+}
+
+// partial counts an object that yielded n records before, or with
+// --recover-gzip around, the damage err describes, and words what happened
+func (sc *scanner) partial(n int64, err error) string {
+	atomic.AddInt64(&sc.stats.ObjectsPartial, 1)
+	var gd *gzipDamage
+	if errors.As(err, &gd) {
+		atomic.AddInt64(&sc.stats.ObjectsRecovered, 1)
+		return fmt.Sprintf("has damaged gzip data (%v); kept the %d records around it", err, n)
+	}
+	return fmt.Sprintf("is truncated or corrupt after %d records (%v); kept those records", n, err)
+}
+
+// processRecovered is process for the worker pool. A panic on one object,
+// some record shape nobody anticipated, is reported with the object's key
+// and counted as a failed object instead of ending a scan that may have
+// run for hours; the records before it still count.
+func (sc *scanner) processRecovered(ctx context.Context, bucket, key string, size int64) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			atomic.AddInt64(&sc.stats.ObjectsFailed, 1)
+			fmt.Fprintf(os.Stderr, "\nInternal error processing s3://%s/%s, skipped the rest of it: %v\n%s", bucket, key, p, debug.Stack())
+			err = nil
+		}
+	}()
+	return sc.process(ctx, bucket, key, size)
+}
+
+// scanStdin runs the events piped in through the same decoding and matching
+// a log object gets, counting the stream as one object. Like a truncated
+// object, input that turns bad part way keeps the records before it.
+func (sc *scanner) scanStdin(ctx context.Context) error {
+	atomic.StoreInt64(&sc.stats.ObjectsListed, 1)
+	n, err := sc.scan(ctx, os.Stdin)
+	atomic.StoreInt64(&sc.stats.ObjectsProcessed, 1)
+	switch {
+	case err != nil && n > 0:
+		fmt.Fprintf(os.Stderr, "Warning: stdin %s\n", sc.partial(n, err))
+	case err != nil:
+		atomic.AddInt64(&sc.stats.ObjectsFailed, 1)
+		return fmt.Errorf("stdin: %w", err)
 	}
-	if len(secrets) > 0 {
-		fmt.Println("\nPotential Secrets Manager secrets:")
-		for _, s := range secretsList(secrets) {
-			fmt.Printf("- %s\n", s)
+	return nil
+}
+
+// scan decodes one (possibly compressed) log file and records its events as
+// they are read, so a truncated or corrupt file still yields every record
+// before the damage. A tar archive of log files is read entry by entry. It
+// returns how many records it examined.
+func (sc *scanner) scan(ctx context.Context, body io.Reader) (int64, error) {
+	var n int64
+	defer func() { atomic.AddInt64(&sc.stats.RecordsExamined, n) }()
+	each := func(raw json.RawMessage) {
+		n++
+		sc.record(ctx, raw)
+	}
+	if recoverGzip {
+		raw := bufferLog(body)
+		if head, _ := raw.Peek(2); bytes.Equal(head, gzipMagic) {
+			return n, gzipMembers(raw, func(member io.Reader) error { return decodeContent(member, each) })
 		}
+		body = raw
+	}
+	logr, err := openLog(body)
+	if err != nil {
+		return 0, err
 	}
+	defer logr.Close()
+	return n, decodeContent(logr, each)
+}
 
-	if outfile != "" {
-		writeOutput(outfile, identity, keysAct, actions, secrets)
+// decodeContent hands every event in a decompressed log object to each,
+// going through a tar archive's log entries one by one
+func decodeContent(r io.Reader, each func(json.RawMessage)) error {
+	br := bufio.NewReader(r)
+	if !isTar(br) {
+		return decodeLog(br, each)
+	}
+	tr := tar.NewReader(br)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !isLogEntry(hdr.Name) {
+			continue
+		}
+		entry, err := openLog(tr)
+		if err == nil {
+			err = decodeLog(entry, each)
+			entry.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
 	}
 }
 
-// getShardPrefixes lists common prefixes up to 'levels' deep
-func getShardPrefixes(ctx context.Context, cli *s3.Client, bucket, base string, levels int) []string {
-	prefixes := []string{base}
-	for lvl := 0; lvl < levels; lvl++ {
-		var next []string
-		for _, p := range prefixes {
-			resp, err := cli.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(p), Delimiter: aws.String("/")})
-			if err != nil {
-				fail(err)
-			}
-			for _, cp := range resp.CommonPrefixes {
-				next = append(next, *cp.Prefix)
+// decodeLog hands every event in a decompressed log file to each, returning
+// nil once the input ends cleanly
+func decodeLog(r io.Reader, each func(json.RawMessage)) error {
+	// concatenated gzip members and newline-delimited events both decode as
+	// back-to-back documents, so keep reading until the stream is exhausted
+	dec := json.NewDecoder(r)
+	for {
+		var err error
+		if inputFraming == "ndjson" {
+			var doc json.RawMessage
+			if err = dec.Decode(&doc); err == nil {
+				each(doc)
 			}
+		} else {
+			err = streamDocument(dec, inputFraming == "auto", each)
 		}
-		if len(next) == 0 {
-			break
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
 		}
-		prefixes = next
 	}
-	return prefixes
 }
 
-func sortedKeys(m map[string]string) []string {
-	ks := make([]string, 0, len(m))
-	for k := range m {
-		ks = append(ks, k)
+// bytesTransferredOut reads additionalEventData.bytesTransferredOut, which
+// CloudTrail writes as a number but some pipelines turn into a string
+func bytesTransferredOut(raw json.RawMessage) int64 {
+	if len(raw) == 0 {
+		return 0
 	}
-	sort.Strings(ks)
-	return ks
+	var data struct {
+		BytesTransferredOut interface{} `json:"bytesTransferredOut"`
+	}
+	if json.Unmarshal(raw, &data) != nil {
+		return 0
+	}
+	switch v := data.BytesTransferredOut.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseFloat(v, 64)
+		return int64(n)
+	}
+	return 0
 }
 
-func process(ctx context.Context, cli *s3.Client, bucket, key, identity string, actions map[string]string, mu *sync.Mutex, secrets map[string]struct{}) {
-	r, err := cli.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+// streamDocument reads one top-level document and hands each event to each
+// as soon as it's decoded. CloudTrail delivers {"Records":[...]} wrappers;
+// Firehose pipelines write one bare event per line. With auto, a document
+// without a Records key is taken as a bare event. It returns io.EOF only at a
+// clean end of input.
+func streamDocument(dec *json.Decoder, auto bool, each func(json.RawMessage)) error {
+	tok, err := dec.Token()
 	if err != nil {
-		return
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("expected a JSON object, got %v", tok)
+	}
+	// until a Records key turns up, an auto document may be a bare event, so
+	// its fields are kept to hand on whole
+	var event bytes.Buffer
+	wrapper := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if key, _ := tok.(string); key == "Records" {
+			wrapper = true
+			if err := streamRecords(dec, each); err != nil {
+				return err
+			}
+			continue
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return unexpectedEOF(err)
+		}
+		if auto && !wrapper {
+			if event.Len() > 0 {
+				event.WriteByte(',')
+			}
+			key, _ := json.Marshal(tok)
+			event.Write(key)
+			event.WriteByte(':')
+			event.Write(v)
+		}
 	}
-	defer r.Body.Close()
+	if _, err := dec.Token(); err != nil {
+		return unexpectedEOF(err)
+	}
+	if auto && !wrapper {
+		each(json.RawMessage("{" + event.String() + "}"))
+	}
+	return nil
+}
 
-	gz, err := gzip.NewReader(r.Body)
+// streamRecords reads the Records array one event at a time
+func streamRecords(dec *json.Decoder, each func(json.RawMessage)) error {
+	tok, err := dec.Token()
 	if err != nil {
-		return
+		return unexpectedEOF(err)
+	}
+	if tok == nil {
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("the Records key isn't an array")
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return unexpectedEOF(err)
+		}
+		each(raw)
 	}
-	defer gz.Close()
+	_, err = dec.Token()
+	return unexpectedEOF(err)
+}
+
+// unexpectedEOF reports input that ends partway through a document, which
+// json.Decoder.Token returns as a plain io.EOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
 
-	var wrapper struct {
-		Records []json.RawMessage `json:"Records"`
+// record aggregates a single CloudTrail record if it belongs to a target identity
+func (sc *scanner) record(ctx context.Context, raw json.RawMessage) {
+	stats, dump := sc.stats, sc.dump
+	var ev struct {
+		EventVersion       string  `json:"eventVersion"`
+		EventTime          string  `json:"eventTime"`
+		EventSource        string  `json:"eventSource"`
+		EventName          string  `json:"eventName"`
+		EventType          string  `json:"eventType"`
+		EventID            string  `json:"eventID"`
+		AWSRegion          string  `json:"awsRegion"`
+		RecipientAccountID string  `json:"recipientAccountId"`
+		RequestID          string  `json:"requestID"`
+		ErrorCode          *string `json:"errorCode"`
+		SourceIPAddress    string  `json:"sourceIPAddress"`
+		UserAgent          string  `json:"userAgent"`
+		UserIdentity       struct {
+			Arn string `json:"arn"`
+		} `json:"userIdentity"`
+		Resources []struct {
+			ARN string `json:"ARN"`
+		} `json:"resources"`
+		// left raw: decoding it into a map for every record dominated CPU,
+		// and only secret extraction needs it
+		RequestParameters json.RawMessage `json:"requestParameters"`
+		// S3 data events report bytesTransferredOut here
+		AdditionalEventData json.RawMessage `json:"additionalEventData"`
 	}
-	if err := json.NewDecoder(gz).Decode(&wrapper); err != nil {
+	if err := json.Unmarshal(raw, &ev); err != nil {
 		return
 	}
-
-	for _, raw := range wrapper.Records {
-		var ev struct {
-			EventTime    string  `json:"eventTime"`
-			EventSource  string  `json:"eventSource"`
-			EventName    string  `json:"eventName"`
-			ErrorCode    *string `json:"errorCode"`
-			UserIdentity struct {
-				Arn string `json:"arn"`
-			} `json:"userIdentity"`
-			RequestParameters map[string]interface{} `json:"requestParameters"`
+	stats.countVersion(ev.EventVersion)
+	if len(eventRegions) > 0 && !slices.Contains(eventRegions, ev.AWSRegion) {
+		return
+	}
+	at, timeOK := parseEventTime(ev.EventTime)
+	if !sourceIPAllows(ev.SourceIPAddress) || !eventInWindow(at, timeOK) {
+		return
+	}
+	if sc.tally != nil {
+		if sc.seen != nil && !sc.seen.firstSighting(ev.EventID) {
+			atomic.AddInt64(&stats.DuplicatesSkipped, 1)
+			return
 		}
-		if err := json.Unmarshal(raw, &ev); err != nil {
-			continue
+		if !filterAllows(raw) {
+			return
 		}
-		norm := normalizeArn(ev.UserIdentity.Arn)
-		if norm != identity || ev.ErrorCode != nil {
-			continue
+		if norm := normalizeArnCached(ev.UserIdentity.Arn); norm != "" {
+			if ignoreCase {
+				norm = strings.ToLower(norm)
+			}
+			sc.tally.mu.Lock()
+			sc.tally.counts[norm]++
+			sc.tally.mu.Unlock()
+		}
+		return
+	}
+	res, ok := sc.target(normalizeArnCached(ev.UserIdentity.Arn))
+	if !ok || ev.ErrorCode != nil && !countAttempts || !filterAllows(raw) {
+		return
+	}
+	if sc.seen != nil && !sc.seen.firstSighting(ev.EventID) {
+		atomic.AddInt64(&stats.DuplicatesSkipped, 1)
+		return
+	}
+	if sc.tags != nil {
+		arns := make([]string, 0, len(ev.Resources))
+		for _, rsrc := range ev.Resources {
+			if rsrc.ARN != "" {
+				arns = append(arns, rsrc.ARN)
+			}
+		}
+		if !sc.tags.matches(ctx, ev.RecipientAccountID, arns) {
+			return
+		}
+	}
+	slr := isServiceLinkedRole(ev.UserIdentity.Arn)
+	if slr && excludeSLR {
+		return
+	}
+	action := strings.Split(ev.EventSource, ".")[0] + ":" + ev.EventName
+	if countAttempts {
+		res.mu.Lock()
+		res.countAttempt(action, ev.ErrorCode)
+		res.mu.Unlock()
+		if ev.ErrorCode != nil {
+			return
+		}
+	}
+	// a future eventTime is still counted with --future-events flag, but never
+	// trusted as a first/last-seen time
+	future := timeOK && at.After(sc.now.Add(clockSkew))
+	if future {
+		atomic.AddInt64(&stats.FutureEvents, 1)
+		if futureEvents == "drop" {
+			return
+		}
+	}
+	atomic.AddInt64(&stats.RecordsMatched, 1)
+	if dump != nil {
+		if err := dump.Write(raw); err != nil {
+			fmt.Fprintln(os.Stderr, "dump error:", err)
+		}
+	}
+	if slr {
+		// a service acting on its own behalf, not something the principal did
+		res.mu.Lock()
+		res.slrActions[action]++
+		res.mu.Unlock()
+		return
+	}
+	// deferred, so a panic the worker recovers from can't leave res locked
+	func() {
+		res.mu.Lock()
+		defer res.mu.Unlock()
+		st, ok := res.actions[action]
+		if !ok {
+			st = &actionStat{Regions: make(map[string]int64), Accounts: make(map[string]int64)}
+			res.actions[action] = st
+			atomic.AddInt64(&stats.actionsFound, 1)
+		}
+		st.Count++
+		if future {
+			res.future = append(res.future, futureEvent{Action: action, EventTime: ev.EventTime, EventID: ev.EventID})
+		}
+		if _, ok := nonAPIEventTypes[ev.EventType]; !ok {
+			st.apiCall = true
+		}
+		// like an unparseable time, a future one only shows until a real one arrives
+		st.seen(ev.EventTime, at, timeOK && !future)
+		if ev.AWSRegion != "" {
+			st.Regions[ev.AWSRegion]++
+		}
+		if ev.RecipientAccountID != "" {
+			st.Accounts[ev.RecipientAccountID]++
+		}
+		if n := bytesTransferredOut(ev.AdditionalEventData); n > 0 {
+			st.BytesOut += n
+			res.bytesOut += n
+		}
+		if groupByDate && !future {
+			day := unknownDay
+			if timeOK {
+				day = at.Format(time.DateOnly)
+			}
+			if res.days[day] == nil {
+				res.days[day] = make(map[string]int64)
+			}
+			res.days[day][action]++
+		}
+		if reconThreshold > 0 && timeOK && !future && isReadOnly(action) {
+			m := readMinute(at)
+			if res.reads[m] == nil {
+				res.reads[m] = make(map[string]struct{})
+			}
+			res.reads[m][action] = struct{}{}
+		}
+		if bizLocation != nil && timeOK && !future && offHours(at) {
+			res.offHours[action]++
+		}
+		if timeOK && !future {
+			if res.first.IsZero() || at.Before(res.first) {
+				res.first = at
+			}
+			if at.After(res.last) {
+				res.last = at
+			}
+		}
+		if format == "boundary" {
+			if st.resources == nil {
+				st.resources = make(map[string]struct{})
+			}
+			named := false
+			for _, rsrc := range ev.Resources {
+				if rsrc.ARN != "" {
+					st.resources[rsrc.ARN] = struct{}{}
+					named = true
+				}
+			}
+			if !named {
+				st.anyResource = true
+			}
+		}
+		if explain {
+			st.offerExample(raw, ev.EventID, ev.EventTime, ev.SourceIPAddress, at, timeOK && !future)
+		}
+		if (format == "json" || format == "json-per-identity") && ev.EventID != "" {
+			if len(st.Events) < eventRefsPerAction {
+				st.Events = append(st.Events, eventRef{EventID: ev.EventID, RequestID: ev.RequestID})
+			} else {
+				st.MoreEvents++
+			}
+		}
+		if ev.SourceIPAddress != "" {
+			res.sourceIPs[ev.SourceIPAddress] = struct{}{}
 		}
-		action := strings.Split(ev.EventSource, ".")[0] + ":" + ev.EventName
-		mu.Lock()
-		if prev, ok := actions[action]; !ok || ev.EventTime > prev {
-			actions[action] = ev.EventTime
+		if ev.UserAgent != "" {
+			res.userAgents[ev.UserAgent] = struct{}{}
+		}
+		if showSessions {
+			if name := sessionName(ev.UserIdentity.Arn); name != "" {
+				res.sessions[name]++
+			}
+		}
+		if listResources || sqlitePath != "" {
+			for _, rsrc := range ev.Resources {
+				if rsrc.ARN != "" {
+					res.resources[rsrc.ARN] = struct{}{}
+				}
+			}
+		}
+		if acct := arnAccount(ev.UserIdentity.Arn); acct != "" {
+			for _, rsrc := range ev.Resources {
+				if other := arnAccount(rsrc.ARN); other != "" && other != acct {
+					res.crossAccount[action] = struct{}{}
+					break
+				}
+			}
 		}
-		mu.Unlock()
+	}()
 
-		if strings.Contains(ev.EventSource, "secretsmanager") && ev.EventName == "GetSecretValue" {
-			if sid, ok := ev.RequestParameters["secretId"].(string); ok {
-				mu.Lock()
-				secrets[sid] = struct{}{}
-				mu.Unlock()
+	if strings.HasPrefix(ev.EventSource, "secretsmanager.") && (ev.EventName == "GetSecretValue" || ev.EventName == "BatchGetSecretValue") {
+		arns := make([]string, 0, len(ev.Resources))
+		for _, rsrc := range ev.Resources {
+			arns = append(arns, rsrc.ARN)
+		}
+		var params map[string]interface{}
+		json.Unmarshal(ev.RequestParameters, &params)
+		if refs := secretRefs(params, arns); len(refs) > 0 {
+			res.mu.Lock()
+			defer res.mu.Unlock()
+			for _, ref := range refs {
+				res.addSecret(ref)
 			}
 		}
 	}
 }
 
-func secretsList(m map[string]struct{}) []string {
+// eventDump streams matched raw records to an NDJSON file
+type eventDump struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func newEventDump(file string) (*eventDump, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	return &eventDump{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Write appends a single record as one line, compacting any embedded newlines
+func (d *eventDump) Write(raw json.RawMessage) error {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err := d.w.Write(buf.Bytes())
+	return err
+}
+
+func (d *eventDump) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.w.Flush(); err != nil {
+		d.f.Close()
+		return err
+	}
+	return d.f.Close()
+}
+
+func sortedSet(m map[string]struct{}) []string {
 	list := make([]string, 0, len(m))
 	for s := range m {
 		list = append(list, s)
@@ -284,27 +2576,104 @@ func secretsList(m map[string]struct{}) []string {
 	return list
 }
 
-func writeOutput(file, identity string, keys []string, actions map[string]string, secrets map[string]struct{}) {
-	f, err := os.Create(file)
-	if err != nil {
-		fail(err)
+// writeText renders the plain-text report
+func writeText(w io.Writer, identity string, keys []string, res *results, stats *scanStats) {
+	fmt.Fprintf(w, "Actions by %s:\n", identity)
+	if span := res.activeSpan(); span != "" {
+		fmt.Fprintln(w, span)
 	}
-	defer f.Close()
-
-	fmt.Fprintf(f, "Actions by %s:\n", identity)
-	for _, a := range keys {
-		fmt.Fprintf(f, "- %s (%s)\n", a, actions[a])
+	if res.bytesOut > 0 {
+		fmt.Fprintf(w, "Data transferred out: %s\n", humanBytes(res.bytesOut))
 	}
-	if len(secrets) > 0 {
-		fmt.Fprintln(f, "\nPotential Secrets Manager secrets:")
-		for _, s := range secretsList(secrets) {
-			fmt.Fprintf(f, "- %s\n", s)
+	if groupByDate {
+		// future-dated events have their own section below
+		for _, d := range res.dayList(keys) {
+			fmt.Fprintf(w, "\n%s:\n", d.Date)
+			for _, da := range d.Actions {
+				fmt.Fprintf(w, "- %s (%d)\n", da.Action, da.Count)
+			}
+		}
+	} else {
+		for _, a := range keys {
+			fmt.Fprintf(w, "- %s (%s)\n", a, res.actions[a].LastSeen)
+			if ex := res.actions[a].example; ex != nil {
+				fmt.Fprintf(w, "    %s\n    %s\n", ex.summary(), ex.Raw)
+			}
 		}
 	}
-	fmt.Println("Finished writing output.")
-}
-
-func fail(err error) {
-	fmt.Fprintln(os.Stderr, err)
-	os.Exit(1)
+	if more := len(res.actions) - len(keys); more > 0 {
+		fmt.Fprintf(w, "... and %d more\n", more)
+	}
+	findings := res.findings()
+	for _, fd := range findings {
+		fmt.Fprintf(w, "\n%s findings [%s]:\n", fd.Category, fd.Severity)
+		if d := fd.detail(); d != "" {
+			fmt.Fprintln(w, strings.ToUpper(d[:1])+d[1:])
+		}
+		for _, a := range fd.Actions {
+			fmt.Fprintf(w, "- %s (%s)\n", a, res.actions[a].LastSeen)
+		}
+	}
+	if len(findings) > 0 {
+		fmt.Fprintf(w, "\nRisk score: %d\n", riskScore(findings))
+	}
+	if len(res.secrets) > 0 {
+		fmt.Fprintln(w, "\nPotential Secrets Manager secrets:")
+		for _, s := range res.secretList() {
+			fmt.Fprintf(w, "- %s\n", s)
+		}
+	}
+	if len(res.slrActions) > 0 {
+		fmt.Fprintln(w, "\nService-linked role activity:")
+		for _, a := range sortedKeys(res.slrActions) {
+			fmt.Fprintf(w, "- %s (%d)\n", a, res.slrActions[a])
+		}
+	}
+	if len(res.future) > 0 {
+		fmt.Fprintln(w, "\nFuture-dated events (suspicious):")
+		for _, fe := range res.futureList() {
+			fmt.Fprintf(w, "- %s at %s (event %s)\n", fe.Action, fe.EventTime, fe.EventID)
+		}
+	}
+	if listResources {
+		fmt.Fprintf(w, "\nResources accessed (%d):\n", len(res.resources))
+		for _, r := range sortedSet(res.resources) {
+			fmt.Fprintf(w, "- %s\n", r)
+		}
+	}
+	if currentPolicy != "" {
+		fmt.Fprintf(w, "\nGranted but never used (%d):\n", len(res.unused))
+		for _, p := range res.unused {
+			fmt.Fprintf(w, "- %s\n", p)
+		}
+	}
+	if showSources {
+		fmt.Fprintln(w, "\nSource IPs:")
+		for _, s := range sortedSet(res.sourceIPs) {
+			fmt.Fprintf(w, "- %s\n", s)
+		}
+		fmt.Fprintln(w, "\nUser agents:")
+		for _, s := range sortedSet(res.userAgents) {
+			fmt.Fprintf(w, "- %s\n", s)
+		}
+	}
+	if countAttempts {
+		fmt.Fprintln(w, "\nAttempts, failed calls included:")
+		for _, a := range sortedKeys(res.attempts) {
+			st := res.attempts[a]
+			fmt.Fprintf(w, "- %s: %d succeeded, %d denied, %d failed\n", a, st.Succeeded, st.Denied, st.Failed)
+		}
+	}
+	if showSessions {
+		fmt.Fprintln(w, "\nSession names:")
+		if len(res.sessions) == 0 {
+			fmt.Fprintln(w, "- (none; the identity was never used as an assumed role)")
+		}
+		for _, s := range sortedKeys(res.sessions) {
+			fmt.Fprintf(w, "- %s (%d events)\n", s, res.sessions[s])
+		}
+	}
+	if showStats {
+		printStats(w, stats)
+	}
 }
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// arnMix builds the userIdentity ARNs of a trail: assumed-role sessions,
+// which dominate, then roles with and without paths, users, roots and
+// federated users, drawn from principals distinct principals with sessions
+// session names each
+func arnMix(principals, sessions int) []string {
+	var arns []string
+	for p := 0; p < principals; p++ {
+		acct := fmt.Sprintf("%012d", 100000000000+p%7)
+		for s := 0; s < sessions; s++ {
+			arns = append(arns, fmt.Sprintf("arn:aws:sts::%s:assumed-role/Role%d/session-%d", acct, p, s))
+		}
+		switch p % 4 {
+		case 0:
+			arns = append(arns, fmt.Sprintf("arn:aws:iam::%s:role/service-role/Role%d", acct, p))
+		case 1:
+			arns = append(arns, fmt.Sprintf("arn:aws:iam::%s:user/engineering/user%d", acct, p))
+		case 2:
+			arns = append(arns, fmt.Sprintf("arn:aws:iam::%s:root", acct))
+		case 3:
+			arns = append(arns, fmt.Sprintf("arn:aws:sts::%s:federated-user/user%d", acct, p))
+		}
+	}
+	return arns
+}
+
+// a trail sees a few dozen principals over and over, or, with per-request
+// session names, a stream of ARNs that hardly repeat and overflow the cache
+var arnMixes = []struct {
+	name string
+	arns []string
+}{
+	{"few-principals", arnMix(50, 4)},
+	{"unique-sessions", arnMix(50, 400)},
+}
+
+func BenchmarkNormalizeArn(b *testing.B) {
+	for _, mix := range arnMixes {
+		b.Run(mix.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				normalizeArn(mix.arns[i%len(mix.arns)])
+			}
+		})
+	}
+}
+
+func BenchmarkNormalizeArnCached(b *testing.B) {
+	for _, mix := range arnMixes {
+		b.Run(mix.name, func(b *testing.B) {
+			// workers normalize records concurrently
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					normalizeArnCached(mix.arns[i%len(mix.arns)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+// fakeLister serves ListObjectsV2 from a fixed set of keys, as S3 does with a
+// delimiter: the keys right under the prefix as contents, the next level
+// down as common prefixes. With pageSize set, common prefixes come that many
+// to a page. Every request is recorded by prefix and continuation token.
+type fakeLister struct {
+	keys     []string
+	pageSize int
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (f *fakeLister) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	prefix, delim, token := aws.ToString(in.Prefix), aws.ToString(in.Delimiter), aws.ToString(in.ContinuationToken)
+	f.mu.Lock()
+	if f.requests == nil {
+		f.requests = make(map[string]int)
+	}
+	f.requests[prefix+"|"+token]++
+	f.mu.Unlock()
+
+	out := &s3.ListObjectsV2Output{}
+	seen := make(map[string]bool)
+	for _, k := range f.keys {
+		rest, ok := strings.CutPrefix(k, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delim); i >= 0 {
+			cp := prefix + rest[:i+len(delim)]
+			if !seen[cp] {
+				seen[cp] = true
+				out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(cp)})
+			}
+			continue
+		}
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(k)})
+	}
+	if f.pageSize > 0 {
+		from, _ := strconv.Atoi(token)
+		if from > 0 {
+			out.Contents = nil
+		}
+		to := min(from+f.pageSize, len(out.CommonPrefixes))
+		if to < len(out.CommonPrefixes) {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = aws.String(strconv.Itoa(to))
+		}
+		out.CommonPrefixes = out.CommonPrefixes[from:to]
+	}
+	return out, nil
+}
+
+func TestGetShardPrefixes(t *testing.T) {
+	defer func(d string, n int) { delimiter, listThreads = d, n }(delimiter, listThreads)
+	delimiter, listThreads = "/", 4
+
+	const day = "111111111111_CloudTrail_us-east-1_20240501T0000Z_a.json.gz"
+	tests := []struct {
+		name   string
+		keys   []string
+		base   string
+		levels int
+		want   []string
+	}{
+		{
+			name:   "leaf right under the root",
+			keys:   []string{"logs/" + day, "logs/b.json.gz"},
+			base:   "",
+			levels: 5,
+			want:   []string{"logs/"},
+		},
+		{
+			name: "deep account layout",
+			keys: []string{
+				"AWSLogs/111111111111/CloudTrail/us-east-1/2024/05/01/" + day,
+				"AWSLogs/111111111111/CloudTrail/us-east-1/2024/05/02/" + day,
+				"AWSLogs/111111111111/CloudTrail/eu-west-1/2024/05/01/" + day,
+			},
+			base:   "AWSLogs/",
+			levels: 8,
+			want: []string{
+				"AWSLogs/111111111111/CloudTrail/eu-west-1/2024/05/01/",
+				"AWSLogs/111111111111/CloudTrail/us-east-1/2024/05/01/",
+				"AWSLogs/111111111111/CloudTrail/us-east-1/2024/05/02/",
+			},
+		},
+		{
+			name: "deep layout cut off at the level limit",
+			keys: []string{
+				"AWSLogs/111111111111/CloudTrail/us-east-1/2024/05/01/" + day,
+				"AWSLogs/111111111111/CloudTrail/eu-west-1/2024/05/01/" + day,
+			},
+			base:   "AWSLogs/",
+			levels: 3,
+			want: []string{
+				"AWSLogs/111111111111/CloudTrail/eu-west-1/",
+				"AWSLogs/111111111111/CloudTrail/us-east-1/",
+			},
+		},
+		{
+			name: "mixed layout",
+			keys: []string{
+				// a flat dump, with a subfolder that's still covered by
+				// listing the dump itself
+				"AWSLogs/222222222222/" + day,
+				"AWSLogs/222222222222/old/" + day,
+				"AWSLogs/333333333333/CloudTrail/us-east-1/2024/05/01/" + day,
+				"AWSLogs/444444444444/",
+			},
+			base:   "AWSLogs/",
+			levels: 8,
+			want: []string{
+				"AWSLogs/222222222222/",
+				"AWSLogs/333333333333/CloudTrail/us-east-1/2024/05/01/",
+				"AWSLogs/444444444444/",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skipped, err := getShardPrefixes(context.Background(), &fakeLister{keys: tt.keys}, "trail", tt.base, tt.levels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(skipped) > 0 {
+				t.Errorf("skipped %v", skipped)
+			}
+			sort.Strings(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// A level wider than a page of common prefixes, as in an organization trail
+// with many accounts, has to be followed across every page, once each
+func TestGetShardPrefixesPaginated(t *testing.T) {
+	defer func(d string, n int) { delimiter, listThreads = d, n }(delimiter, listThreads)
+	delimiter, listThreads = "/", 4
+
+	var keys, want []string
+	for i := 0; i < 7; i++ {
+		acct := fmt.Sprintf("AWSLogs/o-example/%012d/", 100000000000+i)
+		keys = append(keys, acct+"CloudTrail/us-east-1/2024/05/01/a.json.gz")
+		want = append(want, acct+"CloudTrail/us-east-1/2024/05/01/")
+	}
+	f := &fakeLister{keys: keys, pageSize: 3}
+	got, _, err := getShardPrefixes(context.Background(), f, "trail", "AWSLogs/o-example/", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// 7 accounts at 3 a page
+	for _, token := range []string{"", "3", "6"} {
+		if n := f.requests["AWSLogs/o-example/|"+token]; n != 1 {
+			t.Errorf("page %q of the account level fetched %d times, want once", token, n)
+		}
+	}
+	for req, n := range f.requests {
+		if n > 1 {
+			t.Errorf("%s fetched %d times", req, n)
+		}
+	}
+}
+
+// With a time window, discovery under an account's CloudTrail/ folder stops
+// at the year folders, and only the window's days are left to list
+func TestShardDiscoveryNarrowsToWindow(t *testing.T) {
+	defer func(d, l string, n int) { delimiter, layout, listThreads = d, l, n }(delimiter, layout, listThreads)
+	defer func(f, l time.Time) { firstDay, lastDay = f, l }(firstDay, lastDay)
+	delimiter, layout, listThreads = "/", "auto", 4
+	setWindowDays(time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 12, 23, 59, 59, 0, time.UTC))
+
+	const base = "AWSLogs/111111111111/CloudTrail/"
+	var keys []string
+	for _, region := range []string{"us-east-1", "eu-west-1"} {
+		for d := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC); d.Month() <= time.March; d = d.AddDate(0, 0, 1) {
+			keys = append(keys, base+region+d.Format("/2006/01/02/")+"a.json.gz")
+		}
+	}
+	f := &fakeLister{keys: keys}
+	levels, err := discoveryDepth(context.Background(), f, "trail", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _, err := getShardPrefixes(context.Background(), f, "trail", base, levels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shards []shard
+	for _, p := range found {
+		shards = append(shards, shard{bucket: "trail", prefix: p})
+	}
+	var got []string
+	for _, sh := range narrowToWindow(shards) {
+		got = append(got, sh.prefix)
+	}
+	sort.Strings(got)
+	var want []string
+	for _, region := range []string{"eu-west-1", "us-east-1"} {
+		// the 13th for files delivered after midnight
+		for day := 10; day <= 13; day++ {
+			want = append(want, fmt.Sprintf("%s%s/2024/02/%02d/", base, region, day))
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for req := range f.requests {
+		if strings.Count(req, "/") > strings.Count(base, "/")+1 {
+			t.Errorf("discovery listed %s, below the year folders", strings.TrimSuffix(req, "|"))
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	mergeOutput string
+	mergeFormat string
+)
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge <file>...",
+	Short: "Combine the json or json-per-identity output of several scans into one result",
+	Long: "Reads the --format json or json-per-identity output of scans run over different buckets, accounts or time windows and " +
+		"writes one result with every identity's actions, secrets, sources and findings combined. Action counts are deduplicated by " +
+		"eventID, so scans that overlap don't count an event twice; byte, per-day, per-session and attempt counts are summed as they are. The output is " +
+		"itself something merge can read.",
+	Args: cobra.MinimumNArgs(1),
+	RunE: runMerge,
+}
+
+// mergeDoc is one JSON document of a scan's output: an identity's report, the
+// stats line json-per-identity ends with, or one of the outputs merge can't
+// combine
+type mergeDoc struct {
+	jsonReport
+	Comparison json.RawMessage `json:"comparison"`
+	Identities json.RawMessage `json:"identities"`
+}
+
+// identityMerge accumulates one identity's reports. Counts are rebuilt from
+// the event IDs every report lists, plus the events that had none.
+type identityMerge struct {
+	res      *results
+	events   map[string]map[string]eventRef // action -> eventID -> event
+	unnamed  map[string]int64               // action -> events without an eventID
+	more     map[string]int64               // action -> events left off the inputs' lists
+	findings []finding
+	future   map[futureEvent]struct{}
+}
+
+func newIdentityMerge() *identityMerge {
+	res := newResults()
+	res.days = make(map[string]map[string]int64)
+	return &identityMerge{
+		res:     res,
+		events:  make(map[string]map[string]eventRef),
+		unnamed: make(map[string]int64),
+		more:    make(map[string]int64),
+		future:  make(map[futureEvent]struct{}),
+	}
+}
+
+func runMerge(cmd *cobra.Command, args []string) error {
+	switch mergeFormat {
+	case "", "json", "json-per-identity":
+	default:
+		return fmt.Errorf("--format for merge must be json or json-per-identity, got %q", mergeFormat)
+	}
+	if _, _, isS3 := parseS3URI(mergeOutput); isS3 {
+		return fmt.Errorf("merge writes --output to a local file, not %s", mergeOutput)
+	}
+	cmd.SilenceUsage = true
+
+	ids := make(map[string]*identityMerge)
+	var stats *scanStats
+	truncated := false
+	for _, file := range args {
+		n := 0
+		err := readMergeDocs(file, func(doc *mergeDoc) error {
+			switch {
+			case doc.Comparison != nil:
+				return fmt.Errorf("--compare-identities output can't be merged")
+			case doc.Identities != nil:
+				return fmt.Errorf("--list-identities output can't be merged")
+			}
+			if doc.Stats != nil {
+				if stats == nil {
+					stats = &scanStats{}
+				}
+				stats.add(doc.Stats)
+			}
+			if doc.Identity == "" {
+				// the stats line of json-per-identity
+				return nil
+			}
+			m, ok := ids[doc.Identity]
+			if !ok {
+				m = newIdentityMerge()
+				ids[doc.Identity] = m
+			}
+			m.add(&doc.jsonReport)
+			truncated = truncated || doc.MoreActions > 0
+			n++
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("%s: no identity reports in it; merge reads the output of --format json or json-per-identity", file)
+		}
+	}
+	if truncated {
+		fmt.Fprintln(os.Stderr, "WARNING: some inputs were cut short by --top-n; actions they left out are missing from the merged result.")
+	}
+
+	format := mergeFormat
+	if format == "" {
+		format = "json"
+		if len(ids) > 1 {
+			format = "json-per-identity"
+		}
+	}
+	if format == "json" {
+		if len(ids) > 1 {
+			return fmt.Errorf("the inputs cover %d identities; --format json holds one, use json-per-identity", len(ids))
+		}
+		for id, m := range ids {
+			report := m.report(id)
+			report.Stats = stats
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			return emit(mergeOutput, data)
+		}
+	}
+	js, err := openJSONStream(mergeOutput)
+	if err != nil {
+		return err
+	}
+	for _, id := range sortedKeys(ids) {
+		js.write(ids[id].report(id))
+	}
+	if stats != nil {
+		js.write(struct {
+			Stats *scanStats `json:"stats"`
+		}{stats})
+	}
+	return js.close()
+}
+
+// readMergeDocs decodes every JSON document in file in turn: one for json
+// output, one per line for json-per-identity or --append
+func readMergeDocs(file string, each func(*mergeDoc) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var doc mergeDoc
+		if err := dec.Decode(&doc); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := each(&doc); err != nil {
+			return err
+		}
+	}
+}
+
+// add folds one of the identity's reports in
+func (m *identityMerge) add(r *jsonReport) {
+	res := m.res
+	if r.ActiveFrom != nil && (res.first.IsZero() || r.ActiveFrom.Before(res.first)) {
+		res.first = r.ActiveFrom.UTC()
+	}
+	if r.ActiveTo != nil && r.ActiveTo.After(res.last) {
+		res.last = r.ActiveTo.UTC()
+	}
+	for _, ja := range r.Actions {
+		st, ok := res.actions[ja.Action]
+		if !ok {
+			st = &actionStat{}
+			res.actions[ja.Action] = st
+			m.events[ja.Action] = make(map[string]eventRef)
+		}
+		t, tok := parseEventTime(ja.LastSeen)
+		st.seen(ja.LastSeen, t, tok)
+		st.BytesOut += ja.BytesOut
+		named := 0
+		for _, ref := range ja.Events {
+			if ref.EventID != "" {
+				m.events[ja.Action][ref.EventID] = ref
+				named++
+			}
+		}
+		m.unnamed[ja.Action] += ja.Count - int64(named)
+		m.more[ja.Action] += ja.MoreEvents
+		if ja.Example != nil {
+			var ev struct {
+				EventID         string `json:"eventID"`
+				EventTime       string `json:"eventTime"`
+				SourceIPAddress string `json:"sourceIPAddress"`
+			}
+			json.Unmarshal(ja.Example, &ev)
+			t, tok := parseEventTime(ev.EventTime)
+			st.offerExample(ja.Example, ev.EventID, ev.EventTime, ev.SourceIPAddress, t, tok)
+		}
+	}
+	res.bytesOut += r.BytesTransferredOut
+	for _, d := range r.ByDate {
+		if res.days[d.Date] == nil {
+			res.days[d.Date] = make(map[string]int64)
+		}
+		for _, da := range d.Actions {
+			res.days[d.Date][da.Action] += da.Count
+		}
+	}
+	for _, fd := range r.Findings {
+		m.addFinding(fd)
+	}
+	for _, s := range r.Secrets {
+		res.addSecret(s)
+	}
+	for a, n := range r.ServiceLinkedRoleActions {
+		res.slrActions[a] += n
+	}
+	for s, n := range r.SessionNames {
+		res.sessions[s] += n
+	}
+	for a, n := range r.Attempts {
+		st := res.attempts[a]
+		st.Succeeded += n.Succeeded
+		st.Denied += n.Denied
+		st.Failed += n.Failed
+		res.attempts[a] = st
+	}
+	for _, fe := range r.FutureEvents {
+		if _, ok := m.future[fe]; !ok {
+			m.future[fe] = struct{}{}
+			res.future = append(res.future, fe)
+		}
+	}
+	for _, set := range []struct {
+		into map[string]struct{}
+		from []string
+	}{{res.resources, r.Resources}, {res.sourceIPs, r.SourceIPs}, {res.userAgents, r.UserAgents}} {
+		for _, v := range set.from {
+			set.into[v] = struct{}{}
+		}
+	}
+	// report what any input reported
+	groupByDate = groupByDate || len(r.ByDate) > 0
+	listResources = listResources || len(r.Resources) > 0
+	showSources = showSources || len(r.SourceIPs) > 0 || len(r.UserAgents) > 0
+	showSessions = showSessions || len(r.SessionNames) > 0
+	countAttempts = countAttempts || len(r.Attempts) > 0
+}
+
+// addFinding unions a finding into the one of the same category and
+// severity; reconnaissance bursts stay apart unless they're the same burst
+func (m *identityMerge) addFinding(fd finding) {
+	for i := range m.findings {
+		have := &m.findings[i]
+		if have.Category != fd.Category || have.Severity != fd.Severity || !sameTime(have.Start, fd.Start) || !sameTime(have.End, fd.End) {
+			continue
+		}
+		have.Actions = unionSorted(have.Actions, fd.Actions)
+		have.Services = unionSorted(have.Services, fd.Services)
+		have.Events += fd.Events
+		return
+	}
+	fd.Actions = unionSorted(nil, fd.Actions)
+	fd.Services = unionSorted(nil, fd.Services)
+	m.findings = append(m.findings, fd)
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// unionSorted returns the distinct strings of a and b in order, nil when
+// there are none
+func unionSorted(a, b []string) []string {
+	out := slices.Concat(a, b)
+	sort.Strings(out)
+	out = slices.Compact(out)
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// findingRank orders merged findings the way classify emits them: rule
+// findings in rule order, then cross-account, exfiltration, off-hours and
+// reconnaissance
+func findingRank(fd finding) int {
+	for i, rule := range findingRules {
+		if rule.Category == fd.Category && rule.Severity == fd.Severity {
+			return i
+		}
+	}
+	switch fd.Category {
+	case crossAccountCategory:
+		return len(findingRules)
+	case exfilCategory:
+		return len(findingRules) + 1
+	case offHoursCategory:
+		return len(findingRules) + 2
+	case reconCategory:
+		return len(findingRules) + 3
+	}
+	return len(findingRules) + 4
+}
+
+// report renders the merged results the way a scan's json output has them
+func (m *identityMerge) report(identity string) jsonReport {
+	for a, st := range m.res.actions {
+		st.Count = m.unnamed[a] + int64(len(m.events[a]))
+		st.Events = nil
+		for _, ref := range m.events[a] {
+			st.Events = append(st.Events, ref)
+		}
+		// the merged list is capped like a scan's
+		sort.Slice(st.Events, func(i, j int) bool { return st.Events[i].EventID < st.Events[j].EventID })
+		st.MoreEvents = m.more[a]
+		if len(st.Events) > eventRefsPerAction {
+			st.MoreEvents += int64(len(st.Events) - eventRefsPerAction)
+			st.Events = st.Events[:eventRefsPerAction]
+		}
+	}
+	report := newJSONReport(identity, sortedKeys(m.res.actions), m.res)
+	// the inputs' findings rather than a reclassification: the scans may
+	// have used their own --rules and thresholds, and bursts can't be
+	// found again without their timelines
+	sort.SliceStable(m.findings, func(i, j int) bool { return findingRank(m.findings[i]) < findingRank(m.findings[j]) })
+	report.Findings = m.findings
+	report.Score = riskScore(m.findings)
+	return report
+}
+
+// add sums another scan's statistics into st
+func (st *scanStats) add(o *scanStats) {
+	for _, p := range []struct{ into, from *int64 }{
+		{&st.ObjectsListed, &o.ObjectsListed}, {&st.ObjectsProcessed, &o.ObjectsProcessed}, {&st.ObjectsFailed, &o.ObjectsFailed},
+		{&st.ObjectsPartial, &o.ObjectsPartial}, {&st.ObjectsRecovered, &o.ObjectsRecovered}, {&st.RecordsExamined, &o.RecordsExamined}, {&st.RecordsMatched, &o.RecordsMatched},
+		{&st.DuplicatesSkipped, &o.DuplicatesSkipped}, {&st.BytesDownloaded, &o.BytesDownloaded}, {&st.GetRequests, &o.GetRequests},
+		{&st.Retries, &o.Retries}, {&st.Throttles, &o.Throttles}, {&st.FutureEvents, &o.FutureEvents},
+	} {
+		*p.into += *p.from
+	}
+	st.ElapsedSeconds += o.ElapsedSeconds
+	// the merged result is as incomplete as its most sampled input
+	if o.SampleRate > 0 && (st.SampleRate == 0 || o.SampleRate < st.SampleRate) {
+		st.SampleRate = o.SampleRate
+	}
+	st.SkippedPrefixes = append(st.SkippedPrefixes, o.SkippedPrefixes...)
+	st.AssumeRoleFailures = append(st.AssumeRoleFailures, o.AssumeRoleFailures...)
+	for v, n := range o.EventVersions {
+		if st.EventVersions == nil {
+			st.EventVersions = make(map[string]int64)
+		}
+		st.EventVersions[v] += n
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// metricsServer exposes scan progress in the Prometheus text format for the
+// duration of a scan
+type metricsServer struct {
+	srv *http.Server
+}
+
+// startMetrics serves /metrics on addr until stop is called
+func startMetrics(addr string, stats *scanStats) (*metricsServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("--metrics-addr: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range []struct {
+			name, kind, help string
+			value            int64
+		}{
+			{"entrails_objects_listed", "gauge", "Log objects queued for processing.", atomic.LoadInt64(&stats.ObjectsListed)},
+			{"entrails_objects_processed_total", "counter", "Log objects processed.", atomic.LoadInt64(&stats.ObjectsProcessed)},
+			{"entrails_objects_failed_total", "counter", "Log objects that couldn't be downloaded or decoded.", atomic.LoadInt64(&stats.ObjectsFailed)},
+			{"entrails_records_examined_total", "counter", "CloudTrail records examined.", atomic.LoadInt64(&stats.RecordsExamined)},
+			{"entrails_records_matched_total", "counter", "CloudTrail records matching the target identities.", atomic.LoadInt64(&stats.RecordsMatched)},
+			{"entrails_bytes_downloaded_total", "counter", "Bytes downloaded from S3.", atomic.LoadInt64(&stats.BytesDownloaded)},
+			{"entrails_get_requests_total", "counter", "S3 GetObject requests made.", atomic.LoadInt64(&stats.GetRequests)},
+			{"entrails_actions_found", "gauge", "Distinct actions found so far, summed over target identities.", atomic.LoadInt64(&stats.actionsFound)},
+		} {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+		}
+	})
+	ms := &metricsServer{srv: &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}}
+	go ms.srv.Serve(ln)
+	return ms, nil
+}
+
+// stop shuts the server down, giving an in-flight scrape a moment to finish
+func (ms *metricsServer) stop() {
+	if ms == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ms.srv.Shutdown(ctx)
+}
@@ -0,0 +1,832 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// scanStats counts what a scan touched; fields are updated atomically by the workers
+type scanStats struct {
+	ObjectsListed    int64 `json:"objectsListed"`
+	ObjectsProcessed int64 `json:"objectsProcessed"`
+	ObjectsFailed    int64 `json:"objectsFailed"`
+	// cut short by a truncated or corrupt tail; the records before it count
+	ObjectsPartial int64 `json:"objectsPartial"`
+	// of those, objects --recover-gzip read on past damaged gzip data
+	ObjectsRecovered int64 `json:"objectsRecovered,omitempty"`
+	RecordsExamined  int64 `json:"recordsExamined"`
+	RecordsMatched   int64 `json:"recordsMatched"`
+	// only counted with --dedupe
+	DuplicatesSkipped int64 `json:"duplicatesSkipped"`
+	BytesDownloaded   int64 `json:"bytesDownloaded"`
+	GetRequests       int64 `json:"getRequests"`
+	Retries           int64 `json:"retries"`
+	Throttles         int64 `json:"throttles"`
+	// matched events dated after now plus --clock-skew, flagged or dropped
+	FutureEvents   int64   `json:"futureEvents"`
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+	// set when --sample-rate limited the scan to a fraction of the objects
+	SampleRate float64 `json:"sampleRate,omitempty"`
+
+	SkippedPrefixes []skippedPrefix `json:"skippedPrefixes,omitempty"`
+	// accounts whose --assume-all-org-accounts role couldn't be assumed
+	AssumeRoleFailures []assumeFailure `json:"assumeRoleFailures,omitempty"`
+	// examined records by eventVersion, "none" for those without one
+	EventVersions map[string]int64 `json:"eventVersions,omitempty"`
+
+	// distinct actions per identity, for --metrics-addr
+	actionsFound int64
+	// eventVersion -> *int64, tallied by the workers until collectVersions
+	versions sync.Map
+}
+
+// rough S3 Standard list prices, good enough for budgeting a scan
+const (
+	getPricePer1000    = 0.0004
+	transferPricePerGB = 0.09
+)
+
+// costEstimate prices a scan's GET requests, plus transfer cost should the
+// scan run outside the bucket's region
+func costEstimate(requests, bytes int64) string {
+	gets := float64(requests) / 1000 * getPricePer1000
+	transfer := float64(bytes) / (1 << 30) * transferPricePerGB
+	return fmt.Sprintf("~$%.2f in requests, ~$%.2f more if transferred out of region", gets, transfer)
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// sizeUnits are the suffixes parseSize accepts, longest first
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseSize reads a byte count such as 500MiB, 5GB or 1048576
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range sizeUnits {
+		if rest, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, mult = strings.TrimSpace(rest), u.n
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(f * float64(mult)), nil
+}
+
+func printStats(w io.Writer, st *scanStats) {
+	fmt.Fprintln(w, "\nScan statistics:")
+	fmt.Fprintf(w, "- objects listed: %d\n", st.ObjectsListed)
+	fmt.Fprintf(w, "- objects processed: %d\n", st.ObjectsProcessed)
+	fmt.Fprintf(w, "- objects failed: %d\n", st.ObjectsFailed)
+	if st.ObjectsPartial > 0 {
+		fmt.Fprintf(w, "- objects partly decoded: %d\n", st.ObjectsPartial)
+		if st.ObjectsRecovered > 0 {
+			fmt.Fprintf(w, "- of those, recovered past gzip damage: %d\n", st.ObjectsRecovered)
+		}
+	}
+	fmt.Fprintf(w, "- records examined: %d\n", st.RecordsExamined)
+	fmt.Fprintf(w, "- records matched: %d\n", st.RecordsMatched)
+	if dedupe {
+		fmt.Fprintf(w, "- duplicate records skipped: %d\n", st.DuplicatesSkipped)
+	}
+	fmt.Fprintf(w, "- bytes downloaded: %d\n", st.BytesDownloaded)
+	fmt.Fprintf(w, "- GET requests: %d\n", st.GetRequests)
+	fmt.Fprintf(w, "- retries: %d (%d throttled)\n", st.Retries, st.Throttles)
+	fmt.Fprintf(w, "- elapsed: %.1fs\n", st.ElapsedSeconds)
+	if st.FutureEvents > 0 {
+		fmt.Fprintf(w, "- future-dated events: %d\n", st.FutureEvents)
+	}
+	if st.SampleRate > 0 {
+		fmt.Fprintf(w, "- sample rate: %g (results are incomplete)\n", st.SampleRate)
+	}
+	if len(st.EventVersions) > 0 {
+		fmt.Fprintf(w, "- event versions: %s\n", versionSummary(st.EventVersions))
+	}
+	if len(st.SkippedPrefixes) > 0 {
+		fmt.Fprintf(w, "- prefixes skipped: %d\n", len(st.SkippedPrefixes))
+	}
+	if len(st.AssumeRoleFailures) > 0 {
+		fmt.Fprintf(w, "- accounts whose role couldn't be assumed: %d\n", len(st.AssumeRoleFailures))
+	}
+}
+
+type jsonAction struct {
+	Action   string     `json:"action"`
+	Count    int64      `json:"count"`
+	LastSeen string     `json:"lastSeen"`
+	BytesOut int64      `json:"bytesOut,omitempty"`
+	Events   []eventRef `json:"events,omitempty"`
+	// matched events left off Events
+	MoreEvents int64 `json:"moreEvents,omitempty"`
+	// the raw event --explain picked for the action
+	Example json.RawMessage `json:"example,omitempty"`
+}
+
+type jsonReport struct {
+	Identity   string       `json:"identity"`
+	ActiveFrom *time.Time   `json:"activeFrom,omitempty"`
+	ActiveTo   *time.Time   `json:"activeTo,omitempty"`
+	Actions    []jsonAction `json:"actions"`
+	// additionalEventData.bytesTransferredOut summed over all events
+	BytesTransferredOut int64 `json:"bytesTransferredOut,omitempty"`
+	// the actions again, by UTC day, with --group-by-date
+	ByDate []dayActivity `json:"byDate,omitempty"`
+	// actions left out by --top-n
+	MoreActions int       `json:"moreActions,omitempty"`
+	Findings    []finding `json:"findings"`
+	Score       int       `json:"score"`
+	Secrets     []string  `json:"secrets"`
+	// actions by service-linked roles, unless --exclude-slr
+	ServiceLinkedRoleActions map[string]int64 `json:"serviceLinkedRoleActions,omitempty"`
+	// events dated in the future, with --future-events flag
+	FutureEvents []futureEvent `json:"futureEvents,omitempty"`
+	// every distinct resource ARN touched, with --list-resources
+	Resources []string `json:"resources,omitempty"`
+	// --current-policy action patterns never used; empty when all were
+	UnusedPermissions []string `json:"unusedPermissions,omitempty"`
+	SourceIPs         []string `json:"sourceIPs,omitempty"`
+	UserAgents        []string `json:"userAgents,omitempty"`
+	// assumed-role session name -> events, with --show-sessions
+	SessionNames map[string]int64 `json:"sessionNames,omitempty"`
+	// every event per action by outcome, with --count-attempts
+	Attempts map[string]attemptStat `json:"attempts,omitempty"`
+	// left out of json-per-identity lines, which end with a stats line instead
+	Stats *scanStats `json:"stats,omitempty"`
+}
+
+// writeJSON emits the results as a single JSON document to file, or stdout when file is empty
+func writeJSON(file, identity string, keys []string, res *results, stats *scanStats) error {
+	report := newJSONReport(identity, keys, res)
+	report.Stats = stats
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return emit(file, data)
+}
+
+// newJSONReport collects one identity's results for the JSON formats
+func newJSONReport(identity string, keys []string, res *results) jsonReport {
+	report := jsonReport{
+		Identity: identity,
+		Actions:  make([]jsonAction, 0, len(keys)),
+		Findings: res.findings(),
+		Secrets:  res.secretList(),
+	}
+	report.FutureEvents = res.futureList()
+	if len(res.slrActions) > 0 {
+		report.ServiceLinkedRoleActions = res.slrActions
+	}
+	report.Score = riskScore(report.Findings)
+	report.BytesTransferredOut = res.bytesOut
+	report.MoreActions = len(res.actions) - len(keys)
+	if !res.first.IsZero() {
+		report.ActiveFrom, report.ActiveTo = &res.first, &res.last
+	}
+	for _, a := range keys {
+		st := res.actions[a]
+		// workers finish out of order; keep the document stable between runs
+		sort.Slice(st.Events, func(i, j int) bool { return st.Events[i].EventID < st.Events[j].EventID })
+		ja := jsonAction{Action: a, Count: st.Count, LastSeen: st.LastSeen, BytesOut: st.BytesOut, Events: st.Events, MoreEvents: st.MoreEvents}
+		if st.example != nil {
+			ja.Example = st.example.Raw
+		}
+		report.Actions = append(report.Actions, ja)
+	}
+	if groupByDate {
+		report.ByDate = res.dayList(keys)
+	}
+	if listResources {
+		report.Resources = sortedSet(res.resources)
+	}
+	report.UnusedPermissions = res.unused
+	if showSources {
+		report.SourceIPs = sortedSet(res.sourceIPs)
+		report.UserAgents = sortedSet(res.userAgents)
+	}
+	if showSessions {
+		report.SessionNames = res.sessions
+	}
+	if countAttempts {
+		report.Attempts = res.attempts
+	}
+	return report
+}
+
+// jsonStream writes --format json-per-identity: one compact JSON document per
+// line, encoded as each identity's results are ready rather than assembled
+// into one large document. Local files and stdout are written as it goes;
+// an s3:// destination is buffered and uploaded on close. The first write
+// error sticks and is returned by close.
+type jsonStream struct {
+	file string
+	f    *os.File
+	buf  *bytes.Buffer
+	enc  *json.Encoder
+	err  error
+}
+
+func openJSONStream(file string) (*jsonStream, error) {
+	js := &jsonStream{file: file}
+	_, _, isS3 := parseS3URI(file)
+	switch {
+	case file == "":
+		js.enc = json.NewEncoder(redactWriter{os.Stdout})
+	case isS3:
+		js.buf = &bytes.Buffer{}
+		js.enc = json.NewEncoder(redactWriter{js.buf})
+	default:
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if appendOutput {
+			// lines from several runs simply follow each other
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(file, flags, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		js.f = f
+		js.enc = json.NewEncoder(redactWriter{f})
+	}
+	return js, nil
+}
+
+func (js *jsonStream) write(v any) {
+	if js.err == nil {
+		js.err = js.enc.Encode(v)
+	}
+}
+
+func (js *jsonStream) close() error {
+	switch {
+	case js.f != nil:
+		if err := js.f.Close(); js.err == nil {
+			js.err = err
+		}
+	case js.buf != nil && js.err == nil:
+		js.err = saveOutput(js.file, js.buf.Bytes())
+	default:
+		return js.err
+	}
+	if js.err != nil {
+		return js.err
+	}
+	fmt.Println("Finished writing output.")
+	return nil
+}
+
+// writeMarkdown renders the results as a Markdown report for tickets and wikis
+func writeMarkdown(file, identity string, keys []string, res *results, stats *scanStats) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Actions by `%s`\n\n", identity)
+	if span := res.activeSpan(); span != "" {
+		fmt.Fprintf(&b, "%s.\n\n", span)
+	}
+	if res.bytesOut > 0 {
+		fmt.Fprintf(&b, "Data transferred out: %s.\n\n", humanBytes(res.bytesOut))
+	}
+	if len(keys) == 0 {
+		b.WriteString("No successful actions found.\n")
+	} else if groupByDate {
+		for i, d := range res.dayList(keys) {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "## %s\n\n| Action | Count |\n|--------|------:|\n", d.Date)
+			for _, da := range d.Actions {
+				fmt.Fprintf(&b, "| `%s` | %d |\n", da.Action, da.Count)
+			}
+		}
+		if more := len(res.actions) - len(keys); more > 0 {
+			fmt.Fprintf(&b, "\n_... and %d more_\n", more)
+		}
+	} else {
+		if explain {
+			b.WriteString("| Action | Count | Last seen | Example event |\n")
+			b.WriteString("|--------|------:|-----------|---------------|\n")
+		} else {
+			b.WriteString("| Action | Count | Last seen |\n")
+			b.WriteString("|--------|------:|-----------|\n")
+		}
+		for _, a := range keys {
+			st := res.actions[a]
+			if explain {
+				fmt.Fprintf(&b, "| `%s` | %d | %s | %s |\n", a, st.Count, st.LastSeen, st.example.summary())
+				continue
+			}
+			fmt.Fprintf(&b, "| `%s` | %d | %s |\n", a, st.Count, st.LastSeen)
+		}
+		if more := len(res.actions) - len(keys); more > 0 {
+			fmt.Fprintf(&b, "\n_... and %d more_\n", more)
+		}
+	}
+	findings := res.findings()
+	for _, fd := range findings {
+		fmt.Fprintf(&b, "\n## %s findings (%s)\n\n", fd.Category, fd.Severity)
+		if d := fd.detail(); d != "" {
+			fmt.Fprintf(&b, "%s%s.\n\n", strings.ToUpper(d[:1]), d[1:])
+		}
+		for _, a := range fd.Actions {
+			fmt.Fprintf(&b, "- `%s` (last seen %s)\n", a, res.actions[a].LastSeen)
+		}
+	}
+	if len(findings) > 0 {
+		fmt.Fprintf(&b, "\n**Risk score:** %d\n", riskScore(findings))
+	}
+	if len(res.secrets) > 0 {
+		b.WriteString("\n## Potential Secrets Manager secrets\n\n")
+		for _, s := range res.secretList() {
+			fmt.Fprintf(&b, "- `%s`\n", s)
+		}
+	}
+	if len(res.slrActions) > 0 {
+		b.WriteString("\n## Service-linked role activity\n\n")
+		for _, a := range sortedKeys(res.slrActions) {
+			fmt.Fprintf(&b, "- `%s` (%d)\n", a, res.slrActions[a])
+		}
+	}
+	if len(res.future) > 0 {
+		b.WriteString("\n## Future-dated events (suspicious)\n\n")
+		for _, fe := range res.futureList() {
+			fmt.Fprintf(&b, "- `%s` at %s (event `%s`)\n", fe.Action, fe.EventTime, fe.EventID)
+		}
+	}
+	if listResources {
+		fmt.Fprintf(&b, "\n## Resources accessed (%d)\n\n", len(res.resources))
+		for _, r := range sortedSet(res.resources) {
+			fmt.Fprintf(&b, "- `%s`\n", r)
+		}
+	}
+	if currentPolicy != "" {
+		fmt.Fprintf(&b, "\n## Granted but never used (%d)\n\n", len(res.unused))
+		for _, p := range res.unused {
+			fmt.Fprintf(&b, "- `%s`\n", p)
+		}
+	}
+	if showSources {
+		b.WriteString("\n## Source IPs\n\n")
+		for _, s := range sortedSet(res.sourceIPs) {
+			fmt.Fprintf(&b, "- `%s`\n", s)
+		}
+		b.WriteString("\n## User agents\n\n")
+		for _, s := range sortedSet(res.userAgents) {
+			fmt.Fprintf(&b, "- `%s`\n", s)
+		}
+	}
+	if countAttempts {
+		b.WriteString("\n## Attempts\n\n")
+		b.WriteString("| Action | Succeeded | Denied | Failed |\n")
+		b.WriteString("|---|---:|---:|---:|\n")
+		for _, a := range sortedKeys(res.attempts) {
+			st := res.attempts[a]
+			fmt.Fprintf(&b, "| `%s` | %d | %d | %d |\n", a, st.Succeeded, st.Denied, st.Failed)
+		}
+	}
+	if showSessions {
+		b.WriteString("\n## Session names\n\n")
+		if len(res.sessions) == 0 {
+			b.WriteString("None; the identity was never used as an assumed role.\n")
+		}
+		for _, s := range sortedKeys(res.sessions) {
+			fmt.Fprintf(&b, "- `%s` (%d events)\n", s, res.sessions[s])
+		}
+	}
+	if showStats {
+		b.WriteString("\n## Scan statistics\n\n")
+		b.WriteString("| Objects listed | Processed | Failed | Records examined | Records matched | Bytes downloaded | GET requests | Elapsed |\n")
+		b.WriteString("|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+		fmt.Fprintf(&b, "| %d | %d | %d | %d | %d | %d | %d | %.1fs |\n", stats.ObjectsListed, stats.ObjectsProcessed, stats.ObjectsFailed,
+			stats.RecordsExamined, stats.RecordsMatched, stats.BytesDownloaded, stats.GetRequests, stats.ElapsedSeconds)
+	}
+	return emit(file, []byte(strings.TrimRight(b.String(), "\n")))
+}
+
+// writeTable renders the results as aligned columns for reading in a terminal.
+// The Regions column is left out when no event carried an awsRegion.
+func writeTable(file, identity string, keys []string, res *results, stats *scanStats) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Actions by %s:\n", identity)
+	if span := res.activeSpan(); span != "" {
+		fmt.Fprintln(&b, span)
+	}
+	if res.bytesOut > 0 {
+		fmt.Fprintf(&b, "Data transferred out: %s\n", humanBytes(res.bytesOut))
+	}
+	b.WriteString("\n")
+	withRegions := false
+	for _, a := range keys {
+		if len(res.actions[a].Regions) > 0 {
+			withRegions = true
+			break
+		}
+	}
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	if withRegions {
+		fmt.Fprintln(tw, "ACTION\tCOUNT\tFIRST SEEN\tLAST SEEN\tREGIONS")
+	} else {
+		fmt.Fprintln(tw, "ACTION\tCOUNT\tFIRST SEEN\tLAST SEEN")
+	}
+	for _, a := range keys {
+		st := res.actions[a]
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s", a, st.Count, st.FirstSeen, st.LastSeen)
+		if withRegions {
+			regions := strings.Join(sortedKeys(st.Regions), ",")
+			if regions == "" {
+				regions = "-"
+			}
+			fmt.Fprintf(tw, "\t%s", regions)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	if more := len(res.actions) - len(keys); more > 0 {
+		fmt.Fprintf(&b, "... and %d more\n", more)
+	}
+
+	if findings := res.findings(); len(findings) > 0 {
+		fmt.Fprintf(&b, "\nFindings (risk score %d):\n\n", riskScore(findings))
+		tw = tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "CATEGORY\tSEVERITY\tACTION\tLAST SEEN")
+		for _, fd := range findings {
+			for _, a := range fd.Actions {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", fd.Category, fd.Severity, a, res.actions[a].LastSeen)
+			}
+		}
+		tw.Flush()
+		for _, fd := range findings {
+			if d := fd.detail(); d != "" {
+				fmt.Fprintf(&b, "%s %s\n", fd.Category, d)
+			}
+		}
+	}
+	if len(res.secrets) > 0 {
+		b.WriteString("\nPotential Secrets Manager secrets:\n")
+		for _, s := range res.secretList() {
+			fmt.Fprintf(&b, "- %s\n", s)
+		}
+	}
+	if len(res.slrActions) > 0 {
+		b.WriteString("\nService-linked role activity:\n")
+		for _, a := range sortedKeys(res.slrActions) {
+			fmt.Fprintf(&b, "- %s (%d)\n", a, res.slrActions[a])
+		}
+	}
+	if len(res.future) > 0 {
+		b.WriteString("\nFuture-dated events (suspicious):\n")
+		for _, fe := range res.futureList() {
+			fmt.Fprintf(&b, "- %s at %s (event %s)\n", fe.Action, fe.EventTime, fe.EventID)
+		}
+	}
+	if listResources {
+		fmt.Fprintf(&b, "\nResources accessed (%d):\n", len(res.resources))
+		for _, r := range sortedSet(res.resources) {
+			fmt.Fprintf(&b, "- %s\n", r)
+		}
+	}
+	if currentPolicy != "" {
+		fmt.Fprintf(&b, "\nGranted but never used (%d):\n", len(res.unused))
+		for _, p := range res.unused {
+			fmt.Fprintf(&b, "- %s\n", p)
+		}
+	}
+	if showSources {
+		b.WriteString("\nSource IPs:\n")
+		for _, s := range sortedSet(res.sourceIPs) {
+			fmt.Fprintf(&b, "- %s\n", s)
+		}
+		b.WriteString("\nUser agents:\n")
+		for _, s := range sortedSet(res.userAgents) {
+			fmt.Fprintf(&b, "- %s\n", s)
+		}
+	}
+	if countAttempts {
+		b.WriteString("\nAttempts, failed calls included:\n\n")
+		tw = tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ACTION\tSUCCEEDED\tDENIED\tFAILED")
+		for _, a := range sortedKeys(res.attempts) {
+			st := res.attempts[a]
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", a, st.Succeeded, st.Denied, st.Failed)
+		}
+		tw.Flush()
+	}
+	if showSessions {
+		b.WriteString("\nSession names:\n")
+		if len(res.sessions) == 0 {
+			b.WriteString("- (none; the identity was never used as an assumed role)\n")
+		}
+		for _, s := range sortedKeys(res.sessions) {
+			fmt.Fprintf(&b, "- %s (%d events)\n", s, res.sessions[s])
+		}
+	}
+	if showStats {
+		printStats(&b, stats)
+	}
+	return emit(file, bytes.TrimRight(b.Bytes(), "\n"))
+}
+
+// writeMatrixCSV emits a wide CSV of event counts with one row per action and
+// one column per account or region (--matrix-by), for pivoting in a
+// spreadsheet
+func writeMatrixCSV(file string, keys []string, res *results) error {
+	cols := make(map[string]struct{})
+	cells := func(st *actionStat) map[string]int64 {
+		if matrixBy == "region" {
+			return st.Regions
+		}
+		return st.Accounts
+	}
+	for _, a := range keys {
+		for c := range cells(res.actions[a]) {
+			cols[c] = struct{}{}
+		}
+	}
+	header := append([]string{"action"}, sortedSet(cols)...)
+
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write(header)
+	for _, a := range keys {
+		counts := cells(res.actions[a])
+		row := make([]string, len(header))
+		row[0] = a
+		for i, c := range header[1:] {
+			row[i+1] = strconv.FormatInt(counts[c], 10)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return emit(file, bytes.TrimRight(b.Bytes(), "\n"))
+}
+
+type jsonComparison struct {
+	Identity    string       `json:"identity"`
+	Score       int          `json:"score"`
+	OnlyActions []jsonAction `json:"onlyActions"`
+}
+
+// writeComparison reports the symmetric difference of two identities' action
+// sets, riskiest identity first
+func writeComparison(file, a, b string, targets map[string]*results, stats *scanStats) error {
+	sides := []struct {
+		id          string
+		self, other *results
+	}{
+		{a, targets[a], targets[b]},
+		{b, targets[b], targets[a]},
+	}
+	var cmp []jsonComparison
+	for _, side := range sides {
+		c := jsonComparison{Identity: side.id, OnlyActions: []jsonAction{}}
+		keys := sortedKeys(side.self.actions)
+		c.Score = riskScore(classify(keys, side.self))
+		for _, act := range keys {
+			if _, shared := side.other.actions[act]; shared {
+				continue
+			}
+			st := side.self.actions[act]
+			c.OnlyActions = append(c.OnlyActions, jsonAction{Action: act, Count: st.Count, LastSeen: st.LastSeen, Events: st.Events, MoreEvents: st.MoreEvents})
+		}
+		cmp = append(cmp, c)
+	}
+	sort.SliceStable(cmp, func(i, j int) bool { return cmp[i].Score > cmp[j].Score })
+
+	if format == "json-per-identity" {
+		// each identity's full results, not just the difference
+		js, err := openJSONStream(file)
+		if err != nil {
+			return err
+		}
+		for _, c := range cmp {
+			res := targets[c.Identity]
+			js.write(newJSONReport(c.Identity, sortedKeys(res.actions), res))
+		}
+		js.write(struct {
+			Stats *scanStats `json:"stats"`
+		}{stats})
+		return js.close()
+	}
+	if format == "json" {
+		data, err := json.MarshalIndent(struct {
+			Comparison []jsonComparison `json:"comparison"`
+			Stats      *scanStats       `json:"stats"`
+		}{cmp, stats}, "", "  ")
+		if err != nil {
+			return err
+		}
+		return emit(file, data)
+	}
+
+	var buf bytes.Buffer
+	for _, c := range cmp {
+		fmt.Fprintf(&buf, "\nActions only performed by %s (risk score %d):\n", c.Identity, c.Score)
+		if len(c.OnlyActions) == 0 {
+			buf.WriteString("- (none)\n")
+		}
+		for _, act := range c.OnlyActions {
+			fmt.Fprintf(&buf, "- %s (%s)\n", act.Action, act.LastSeen)
+		}
+	}
+	if showStats {
+		printStats(&buf, stats)
+	}
+	out := redact(buf.Bytes())
+	fmt.Print(string(out))
+	if file != "" {
+		if err := saveOutput(file, out); err != nil {
+			return err
+		}
+		fmt.Println("Finished writing output.")
+	}
+	return nil
+}
+
+type jsonIdentity struct {
+	Identity string `json:"identity"`
+	Events   int64  `json:"events"`
+}
+
+// writeIdentities lists discovered identities, most active first
+func writeIdentities(file string, tally *identityTally, stats *scanStats) error {
+	ids := make([]jsonIdentity, 0, len(tally.counts))
+	for id, n := range tally.counts {
+		ids = append(ids, jsonIdentity{Identity: id, Events: n})
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].Events != ids[j].Events {
+			return ids[i].Events > ids[j].Events
+		}
+		return ids[i].Identity < ids[j].Identity
+	})
+	more := 0
+	if topN > 0 && len(ids) > topN {
+		more = len(ids) - topN
+		ids = ids[:topN]
+	}
+
+	if format == "json-per-identity" {
+		js, err := openJSONStream(file)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			js.write(id)
+		}
+		js.write(struct {
+			MoreIdentities int        `json:"moreIdentities,omitempty"`
+			Stats          *scanStats `json:"stats"`
+		}{more, stats})
+		return js.close()
+	}
+	if format == "json" {
+		data, err := json.MarshalIndent(struct {
+			Identities     []jsonIdentity `json:"identities"`
+			MoreIdentities int            `json:"moreIdentities,omitempty"`
+			Stats          *scanStats     `json:"stats"`
+		}{ids, more, stats}, "", "  ")
+		if err != nil {
+			return err
+		}
+		return emit(file, data)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "\nIdentities seen (%d):\n", len(ids)+more)
+	for _, id := range ids {
+		fmt.Fprintf(&buf, "- %s (%d events)\n", id.Identity, id.Events)
+	}
+	if more > 0 {
+		fmt.Fprintf(&buf, "... and %d more\n", more)
+	}
+	if showStats {
+		printStats(&buf, stats)
+	}
+	out := redact(buf.Bytes())
+	fmt.Print(string(out))
+	if file != "" {
+		if err := saveOutput(file, out); err != nil {
+			return err
+		}
+		fmt.Println("Finished writing output.")
+	}
+	return nil
+}
+
+// emit writes a rendered document to file, or stdout when file is empty
+func emit(file string, data []byte) error {
+	data = redact(data)
+	if file == "" {
+		fmt.Println(string(data))
+		return nil
+	}
+	if err := saveOutput(file, append(data, '\n')); err != nil {
+		return err
+	}
+	fmt.Println("Finished writing output.")
+	return nil
+}
+
+// outputClient uploads results when --output is an s3:// URI
+var outputClient *s3.Client
+
+// saveOutput writes data to a local path, or uploads it when path is s3://bucket/key
+func saveOutput(path string, data []byte) error {
+	if b, k, ok := parseS3URI(path); ok {
+		_, err := outputClient.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String(b),
+			Key:    aws.String(k),
+			Body:   bytes.NewReader(data),
+		})
+		if err != nil {
+			return fmt.Errorf("upload to %s: %w", path, err)
+		}
+		return nil
+	}
+	if appendOutput {
+		return appendFile(path, data)
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// appendFile adds this run's results to the end of path. JSON reports are
+// compacted onto one line so the file stays NDJSON; other formats get a
+// timestamped header separating runs.
+func appendFile(path string, data []byte) error {
+	var buf bytes.Buffer
+	if format == "json" {
+		if err := json.Compact(&buf, data); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+	} else {
+		fmt.Fprintf(&buf, "=== entrails run %s ===\n", time.Now().UTC().Format(time.RFC3339))
+		buf.Write(data)
+		if !bytes.HasSuffix(data, []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		buf.WriteByte('\n')
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func parseS3URI(uri string) (bucket, key string, ok bool) {
+	rest, ok := strings.CutPrefix(uri, "s3://")
+	if !ok {
+		return "", "", false
+	}
+	bucket, key, _ = strings.Cut(rest, "/")
+	if strings.HasPrefix(bucket, "arn:") {
+		// an access point ARN ends in accesspoint/<name>
+		name, k, _ := strings.Cut(key, "/")
+		bucket, key = bucket+"/"+name, k
+	}
+	if bucket == "" || key == "" {
+		return "", "", false
+	}
+	return bucket, key, true
+}
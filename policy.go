@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// iamPolicy mirrors the subset of the IAM policy grammar we emit
+type iamPolicy struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Sid       string          `json:"Sid,omitempty"`
+	Effect    string          `json:"Effect"`
+	Action    []string        `json:"Action,omitempty"`
+	NotAction []string        `json:"NotAction,omitempty"`
+	Resource  interface{}     `json:"Resource"`
+	Condition policyCondition `json:"Condition,omitempty"`
+}
+
+// policyCondition is an IAM Condition block: operator -> key -> value(s)
+type policyCondition map[string]map[string]interface{}
+
+// CloudTrail event source prefixes whose IAM service prefix differs
+var iamPrefixOverrides = map[string]string{
+	"monitoring": "cloudwatch",
+	"email":      "ses",
+	"tagging":    "tag",
+}
+
+// CloudTrail eventTypes that record something other than an API call:
+// console sign-ins, console-only actions, and work services do on their own.
+// They matter to an investigation but no policy statement grants them.
+var nonAPIEventTypes = map[string]struct{}{
+	"AwsConsoleSignIn": {},
+	"AwsConsoleAction": {},
+	"AwsServiceEvent":  {},
+}
+
+// event sources that show up in CloudTrail but have no IAM actions behind them
+var nonIAMSources = map[string]struct{}{
+	"signin": {},
+}
+
+var (
+	iamPrefixRe = regexp.MustCompile(`^[a-z0-9-]+$`)
+	iamActionRe = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+)
+
+// action name prefixes that only read state
+var readOnlyPrefixes = []string{"Get", "List", "Describe", "Head", "Lookup", "Search", "Scan", "Query", "BatchGet", "View", "Select"}
+
+// isReadOnly guesses from the event name whether an action only reads state
+func isReadOnly(action string) bool {
+	_, name, _ := strings.Cut(action, ":")
+	if _, ok := readOnlyMethods[name]; ok {
+		return true
+	}
+	for _, p := range readOnlyPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// sidNames spells well-known IAM service prefixes the way AWS does, for
+// --statements-per-service Sids; others are capitalized per dash-separated part
+var sidNames = map[string]string{
+	"acm": "ACM", "apigateway": "APIGateway", "cloudformation": "CloudFormation", "cloudfront": "CloudFront",
+	"cloudtrail": "CloudTrail", "cloudwatch": "CloudWatch", "dynamodb": "DynamoDB", "ec2": "EC2", "ecr": "ECR",
+	"ecs": "ECS", "eks": "EKS", "elasticloadbalancing": "ElasticLoadBalancing", "guardduty": "GuardDuty",
+	"iam": "IAM", "kms": "KMS", "rds": "RDS", "s3": "S3", "secretsmanager": "SecretsManager", "ses": "SES",
+	"sns": "SNS", "sqs": "SQS", "ssm": "SSM", "sso": "SSO", "sts": "STS",
+}
+
+// sidName turns an IAM service prefix into the start of a statement Sid,
+// which may only hold letters and digits
+func sidName(svc string) string {
+	if name, ok := sidNames[svc]; ok {
+		return name
+	}
+	var b strings.Builder
+	for _, part := range strings.Split(svc, "-") {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+// buildPolicy turns observed actions into an allow policy, returning the
+// actions that had to be left out. With split set, read-only and mutating
+// actions get their own statements, and with perService every IAM service
+// does; cond, if any, is attached to each. resources replaces a service's
+// Resource "*" with its ARNs.
+func buildPolicy(actions []string, split, perService bool, cond policyCondition, resources map[string][]string) (iamPolicy, []string) {
+	// a statement's service ("" unless perService) and access ("Read",
+	// "Write", or "" unless split)
+	type group struct{ svc, access string }
+	groups := make(map[group]map[string]struct{})
+	var unmapped []string
+	for _, a := range actions {
+		mapped, ok := iamActions(a)
+		if !ok {
+			unmapped = append(unmapped, a)
+			continue
+		}
+		for _, m := range mapped {
+			var g group
+			if perService {
+				g.svc, _, _ = strings.Cut(m, ":")
+			}
+			if split {
+				g.access = "Read"
+				if !isReadOnly(m) {
+					g.access = "Write"
+				}
+			}
+			if groups[g] == nil {
+				groups[g] = make(map[string]struct{})
+			}
+			groups[g][m] = struct{}{}
+		}
+	}
+	sort.Strings(unmapped)
+
+	policy := iamPolicy{Version: "2012-10-17"}
+	if !split && !perService {
+		policy.Statement = []policyStatement{{Effect: "Allow", Action: sortedSet(groups[group{}]), Resource: "*", Condition: cond}}
+		return policy, unmapped
+	}
+	keys := make([]group, 0, len(groups))
+	for g := range groups {
+		keys = append(keys, g)
+	}
+	// by service, reads before writes
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].svc != keys[j].svc {
+			return keys[i].svc < keys[j].svc
+		}
+		return keys[i].access < keys[j].access
+	})
+	for _, g := range keys {
+		var resource interface{} = "*"
+		switch arns := resources[g.svc]; len(arns) {
+		case 0:
+		case 1:
+			resource = arns[0]
+		default:
+			resource = arns
+		}
+		policy.Statement = append(policy.Statement, policyStatement{Sid: sidName(g.svc) + g.access + "Access", Effect: "Allow",
+			Action: sortedSet(groups[g]), Resource: resource, Condition: cond})
+	}
+	return policy, unmapped
+}
+
+// parseServiceResources reads --service-resource service=ARN values into the
+// ARNs per IAM service prefix
+func parseServiceResources(specs []string) (map[string][]string, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	out := make(map[string][]string)
+	for _, spec := range specs {
+		svc, arn, _ := strings.Cut(spec, "=")
+		svc, arn = strings.TrimSpace(svc), strings.TrimSpace(arn)
+		if !iamPrefixRe.MatchString(svc) || !strings.HasPrefix(arn, "arn:") {
+			return nil, fmt.Errorf("--service-resource wants service=ARN, e.g. s3=arn:aws:s3:::my-bucket/*, got %q", spec)
+		}
+		out[svc] = append(out[svc], arn)
+	}
+	return out, nil
+}
+
+// parsePolicyCondition accepts either a raw Condition JSON object or
+// comma-separated key,value pairs. Pairs use IpAddress for aws:SourceIp and
+// StringEquals for everything else; repeating a key collects its values.
+func parsePolicyCondition(spec string) (policyCondition, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(spec), "{") {
+		var cond policyCondition
+		if err := json.Unmarshal([]byte(spec), &cond); err != nil {
+			return nil, fmt.Errorf("--policy-condition: %w", err)
+		}
+		return cond, nil
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("--policy-condition wants key,value pairs, got %q", spec)
+	}
+	cond := make(policyCondition)
+	for i := 0; i < len(parts); i += 2 {
+		key, value := strings.TrimSpace(parts[i]), strings.TrimSpace(parts[i+1])
+		op := "StringEquals"
+		if strings.EqualFold(key, "aws:SourceIp") {
+			op = "IpAddress"
+		}
+		if cond[op] == nil {
+			cond[op] = make(map[string]interface{})
+		}
+		switch prev := cond[op][key].(type) {
+		case nil:
+			cond[op][key] = value
+		case string:
+			cond[op][key] = []string{prev, value}
+		case []string:
+			cond[op][key] = append(prev, value)
+		}
+	}
+	return cond, nil
+}
+
+// policyFormat reports whether --format emits an IAM policy document, which
+// needs every observed action and nothing else
+func policyFormat() bool {
+	return format == "iam-policy" || format == "boundary"
+}
+
+// maxManagedPolicySize is IAM's limit on a managed policy document, not
+// counting whitespace; a permissions boundary has to be a managed policy
+const maxManagedPolicySize = 6144
+
+// resourceValue renders a statement's Resource: "*" for no ARNs, a string
+// for one, a list otherwise
+func resourceValue(arns []string) interface{} {
+	switch len(arns) {
+	case 0:
+		return "*"
+	case 1:
+		return arns[0]
+	}
+	return arns
+}
+
+// buildBoundary turns observed actions into a permissions boundary: Allow
+// statements that grant each action on the resources its events touched (or
+// on * when any of them named none), grouped by resource set, and a Deny for every
+// action outside them. An identity's permissions are the overlap of its
+// policies and its boundary, so this caps it at what it was seen using.
+func buildBoundary(actions []string, res *results, cond policyCondition) (iamPolicy, []string) {
+	// IAM action -> resource ARNs, merged over the event names mapping to it
+	granted := make(map[string]map[string]struct{})
+	anywhere := make(map[string]bool)
+	var unmapped []string
+	for _, a := range actions {
+		mapped, ok := iamActions(a)
+		if !ok {
+			unmapped = append(unmapped, a)
+			continue
+		}
+		st := res.actions[a]
+		for _, m := range mapped {
+			if granted[m] == nil {
+				granted[m] = make(map[string]struct{})
+			}
+			for arn := range st.resources {
+				granted[m][arn] = struct{}{}
+			}
+			if st.anyResource {
+				anywhere[m] = true
+			}
+		}
+	}
+	sort.Strings(unmapped)
+
+	// resource set, joined -> actions
+	groups := make(map[string][]string)
+	for _, mapped := range sortedKeys(granted) {
+		key := ""
+		if !anywhere[mapped] {
+			key = strings.Join(sortedSet(granted[mapped]), "\n")
+		}
+		groups[key] = append(groups[key], mapped)
+	}
+	policy := iamPolicy{Version: "2012-10-17"}
+	n := 0
+	for _, key := range sortedKeys(groups) {
+		sid := "ObservedActions"
+		var arns []string
+		if key != "" {
+			n++
+			sid = fmt.Sprintf("ObservedActionsOnResources%d", n)
+			arns = strings.Split(key, "\n")
+		}
+		policy.Statement = append(policy.Statement, policyStatement{Sid: sid, Effect: "Allow", Action: groups[key], Resource: resourceValue(arns), Condition: cond})
+	}
+	if len(granted) > 0 {
+		policy.Statement = append(policy.Statement, policyStatement{Sid: "DenyUnobservedActions", Effect: "Deny", NotAction: sortedKeys(granted), Resource: "*"})
+	}
+	return policy, unmapped
+}
+
+// writePolicy emits the generated policy, or with --format boundary the
+// permissions boundary, to file, or stdout when file is empty. Actions only
+// seen in non-API events are left out and listed separately.
+func writePolicy(file string, actions []string, res *results) error {
+	cond, err := parsePolicyCondition(policyConditionSpec)
+	if err != nil {
+		return err
+	}
+	var api, events []string
+	for _, a := range actions {
+		if res.actions[a].apiCall {
+			api = append(api, a)
+		} else {
+			events = append(events, a)
+		}
+	}
+	var policy iamPolicy
+	var unmapped []string
+	if format == "boundary" {
+		policy, unmapped = buildBoundary(api, res, cond)
+	} else {
+		resources, err := parseServiceResources(serviceResources)
+		if err != nil {
+			return err
+		}
+		policy, unmapped = buildPolicy(api, splitReadWrite, statementsPerService, cond, resources)
+		for _, svc := range sortedKeys(resources) {
+			if !slices.ContainsFunc(policy.Statement, func(st policyStatement) bool { return strings.HasPrefix(st.Action[0], svc+":") }) {
+				fmt.Fprintf(os.Stderr, "WARNING: --service-resource names %s, which no statement grants; ignored.\n", svc)
+			}
+		}
+	}
+	if len(policy.Statement) == 0 || len(policy.Statement[0].Action) == 0 {
+		reportLeftOut(unmapped, events)
+		return fmt.Errorf("no IAM actions were observed to put in a policy, and IAM rejects a statement without any")
+	}
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := emit(file, data); err != nil {
+		return err
+	}
+	if compact, _ := json.Marshal(policy); format == "boundary" && len(compact) > maxManagedPolicySize {
+		fmt.Fprintf(os.Stderr, "\nWARNING: the boundary is %d characters, over IAM's %d for a managed policy; trim it or split the identity's work before attaching it.\n", len(compact), maxManagedPolicySize)
+	}
+
+	reportLeftOut(unmapped, events)
+	return nil
+}
+
+// reportLeftOut lists on stderr the actions a policy couldn't include
+func reportLeftOut(unmapped, events []string) {
+	if len(unmapped) > 0 {
+		fmt.Fprintf(os.Stderr, "\nWARNING: %d action(s) could not be mapped to IAM and were left out of the policy; it may be incomplete:\n", len(unmapped))
+		for _, a := range unmapped {
+			fmt.Fprintf(os.Stderr, "- %s\n", a)
+		}
+	}
+	if len(events) > 0 {
+		fmt.Fprintf(os.Stderr, "\nLeft out %d action(s) seen only in console sign-in or service events, which aren't IAM actions:\n", len(events))
+		for _, a := range events {
+			fmt.Fprintf(os.Stderr, "- %s\n", a)
+		}
+	}
+}
+
+// stringOrSlice accepts the IAM grammar's "one string or a list of strings"
+type stringOrSlice []string
+
+func (s *stringOrSlice) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = []string{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*s = many
+	return nil
+}
+
+// loadPolicyActions reads an IAM policy document and returns the action
+// patterns granted by its Allow statements
+func loadPolicyActions(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Statement json.RawMessage `json:"Statement"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	type statement struct {
+		Effect string        `json:"Effect"`
+		Action stringOrSlice `json:"Action"`
+	}
+	var stmts []statement
+	if err := json.Unmarshal(doc.Statement, &stmts); err != nil {
+		var one statement
+		if err := json.Unmarshal(doc.Statement, &one); err != nil {
+			return nil, fmt.Errorf("%s: bad Statement: %w", file, err)
+		}
+		stmts = []statement{one}
+	}
+	var patterns []string
+	for _, st := range stmts {
+		if !strings.EqualFold(st.Effect, "Allow") {
+			continue
+		}
+		patterns = append(patterns, st.Action...)
+	}
+	return patterns, nil
+}
+
+// unusedPatterns returns the policy's action patterns that none of the
+// observed actions matches, sorted and without repeats. A wildcard counts as
+// used if any call matched it: s3:Get* is only unused when no s3:Get... call
+// was seen, since there's no complete action list to expand it against.
+func unusedPatterns(patterns, actions []string) []string {
+	observed := make([]string, 0, len(actions))
+	for _, a := range actions {
+		mapped, ok := iamActions(a)
+		if !ok {
+			mapped = []string{a}
+		}
+		for _, m := range mapped {
+			observed = append(observed, strings.ToLower(m))
+		}
+	}
+	unused := make(map[string]struct{})
+	for _, p := range patterns {
+		used := false
+		for _, a := range observed {
+			if wildcardMatch(strings.ToLower(p), a) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			unused[p] = struct{}{}
+		}
+	}
+	return sortedKeys(unused)
+}
+
+// actionCovered reports whether the policy patterns grant the action, every
+// IAM action it takes when it takes several. IAM matches actions
+// case-insensitively, with * and ? wildcards.
+func actionCovered(action string, patterns []string) bool {
+	mapped, ok := iamActions(action)
+	if !ok {
+		mapped = []string{action}
+	}
+	for _, m := range mapped {
+		if !slices.ContainsFunc(patterns, func(p string) bool { return wildcardMatch(strings.ToLower(p), strings.ToLower(m)) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// wildcardMatch matches s against a pattern where * spans any run of
+// characters (including none) and ? matches exactly one
+func wildcardMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case star != -1:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// objectGetter is the part of the S3 client workers fetch log objects with
+type objectGetter interface {
+	GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// get issues one GetObject, for the byte range rng unless it's "", and
+// repeats it once if the credentials expired under it. A stageError means
+// they couldn't be renewed and the scan can't go on; any other error is the
+// object's alone.
+func (sc *scanner) get(ctx context.Context, bucket, key, rng string) (*s3.GetObjectOutput, error) {
+	in := &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+	if rng != "" {
+		in.Range = aws.String(rng)
+	}
+	atomic.AddInt64(&sc.stats.GetRequests, 1)
+	gen := sc.creds.generation()
+	r, err := sc.s3.GetObject(ctx, in)
+	if isExpiredToken(err) {
+		// dropping every object from here on would quietly gut the results
+		if err := sc.creds.refresh(ctx, gen); err != nil {
+			return nil, inStage(stageGet, fmt.Errorf("s3://%s/%s: %w", bucket, key, err))
+		}
+		atomic.AddInt64(&sc.stats.GetRequests, 1)
+		r, err = sc.s3.GetObject(ctx, in)
+		if isExpiredToken(err) {
+			return nil, inStage(stageGet, fmt.Errorf("s3://%s/%s: %w (still rejected after a refresh)", bucket, key, errCredentialsExpired))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&sc.stats.BytesDownloaded, aws.ToInt64(r.ContentLength))
+	return r, nil
+}
+
+type partResult struct {
+	data []byte
+	err  error
+}
+
+// rangedBody reassembles an object from concurrent ranged GETs of
+// --part-size, passing the parts on in order. At most --part-concurrency
+// parts are in flight or waiting to be read, which bounds its memory.
+type rangedBody struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+	done   chan struct{}
+	// a credentials failure that ends the scan; read it after Close
+	fatal error
+}
+
+// getRanged starts fetching an object of the listed size in parts
+func (sc *scanner) getRanged(ctx context.Context, bucket, key string, size int64) *rangedBody {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	rb := &rangedBody{PipeReader: pr, cancel: cancel, done: make(chan struct{})}
+
+	parts := make([]chan partResult, (size+partSize-1)/partSize)
+	for i := range parts {
+		parts[i] = make(chan partResult, 1)
+	}
+	slots := make(chan struct{}, partConcurrency)
+	go func() {
+		for i := range parts {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			from := int64(i) * partSize
+			to := min(from+partSize, size) - 1
+			go func() { parts[i] <- sc.getPart(ctx, bucket, key, from, to) }()
+		}
+	}()
+	go func() {
+		defer close(rb.done)
+		for _, part := range parts {
+			var p partResult
+			select {
+			case p = <-part:
+			case <-ctx.Done():
+				pw.CloseWithError(ctx.Err())
+				return
+			}
+			<-slots
+			if p.err != nil {
+				var se *stageError
+				if errors.As(p.err, &se) {
+					rb.fatal = p.err
+				}
+				pw.CloseWithError(p.err)
+				return
+			}
+			if _, err := pw.Write(p.data); err != nil {
+				// the reader gave up on the object
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return rb
+}
+
+// getPart fetches the bytes from to to, inclusive
+func (sc *scanner) getPart(ctx context.Context, bucket, key string, from, to int64) partResult {
+	r, err := sc.get(ctx, bucket, key, fmt.Sprintf("bytes=%d-%d", from, to))
+	if err != nil {
+		return partResult{err: err}
+	}
+	defer r.Body.Close()
+	data, err := io.ReadAll(r.Body)
+	return partResult{data, err}
+}
+
+// Close stops the fetches still going and waits for the reassembly to end,
+// after which fatal can be read
+func (rb *rangedBody) Close() error {
+	rb.cancel()
+	err := rb.PipeReader.Close()
+	<-rb.done
+	return err
+}
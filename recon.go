@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reconCategory collects the read-only actions of an enumeration burst: at
+// least --recon-threshold distinct Describe/List/Get-style actions, across
+// reconMinServices services, within --recon-window
+const reconCategory = "Reconnaissance"
+
+const reconSeverity = "medium"
+
+// reconMinServices keeps one service's paging through its own resources,
+// a console page load say, from counting as enumeration
+const reconMinServices = 3
+
+// readMinute is the bucket read-only actions are timed in: bursts are found
+// over minutes, so memory grows with the identity's active minutes rather
+// than its events
+func readMinute(t time.Time) int64 {
+	return t.Unix() / 60
+}
+
+// reconBursts finds the windows in which the identity enumerated broadly,
+// earliest first. Windows start at a minute with read activity and don't
+// overlap; each reports only the minutes that had reads in it.
+func reconBursts(res *results) []finding {
+	if reconThreshold <= 0 || len(res.reads) == 0 {
+		return nil
+	}
+	minutes := make([]int64, 0, len(res.reads))
+	for m := range res.reads {
+		minutes = append(minutes, m)
+	}
+	sort.Slice(minutes, func(i, j int) bool { return minutes[i] < minutes[j] })
+	span := int64(reconWindow / time.Minute)
+
+	var out []finding
+	for i := 0; i < len(minutes); {
+		actions := make(map[string]struct{})
+		j := i
+		for ; j < len(minutes) && minutes[j] < minutes[i]+span; j++ {
+			for a := range res.reads[minutes[j]] {
+				// --baseline-policy may have dropped it
+				if _, ok := res.actions[a]; ok {
+					actions[a] = struct{}{}
+				}
+			}
+		}
+		services := make(map[string]struct{})
+		for a := range actions {
+			svc, _, _ := strings.Cut(a, ":")
+			services[svc] = struct{}{}
+		}
+		if len(actions) < reconThreshold || len(services) < reconMinServices {
+			i++
+			continue
+		}
+		start := time.Unix(minutes[i]*60, 0).UTC()
+		end := time.Unix(minutes[j-1]*60+59, 0).UTC()
+		out = append(out, finding{Category: reconCategory, Severity: reconSeverity, Actions: sortedSet(actions),
+			Start: &start, End: &end, Services: sortedSet(services)})
+		i = j
+	}
+	return out
+}
+
+// detail describes when and where a finding happened, for the findings
+// that have more to them than their actions; "" for the rest
+func (fd finding) detail() string {
+	if fd.Category == offHoursCategory && bizLocation != nil {
+		return fmt.Sprintf("%d events outside %s %s", fd.Events, businessHours, bizLocation)
+	}
+	if fd.Start == nil {
+		return ""
+	}
+	return fmt.Sprintf("between %s and %s, across %d services: %s", fd.Start.Format(time.RFC3339), fd.End.Format(time.RFC3339),
+		len(fd.Services), strings.Join(fd.Services, ", "))
+}
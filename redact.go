@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var (
+	arnRe       = regexp.MustCompile("arn:(aws[a-z-]*):([a-z0-9-]*):([a-z0-9-]*):([0-9]{12})?:([^\\s\"'`,|()]+)")
+	accountIDIn = regexp.MustCompile(`\b[0-9]{12}\b`)
+)
+
+// redactKey keys the pseudonyms; it's drawn fresh every run, so names are
+// consistent within a report but can't be linked to a previous one or
+// reversed by hashing every possible account ID
+var redactKey = func() []byte {
+	k := make([]byte, 32)
+	rand.Read(k)
+	return k
+}()
+
+// pseudonym maps an identifier to a stable stand-in for this run
+func pseudonym(kind, id string) string {
+	m := hmac.New(sha256.New, redactKey)
+	m.Write([]byte(kind + ":" + id))
+	return kind + "-" + hex.EncodeToString(m.Sum(nil))[:8]
+}
+
+// redact applies --redact to rendered output. With accounts, account IDs,
+// inside ARNs or on their own, become pseudonyms; with arns, the resource
+// part of every ARN is masked too, keeping only its resource type.
+func redact(data []byte) []byte {
+	if redactMode == "" {
+		return data
+	}
+	s := arnRe.ReplaceAllStringFunc(string(data), func(arn string) string {
+		m := arnRe.FindStringSubmatch(arn)
+		partition, service, region, account, resource := m[1], m[2], m[3], m[4], m[5]
+		if account != "" {
+			account = pseudonym("acct", account)
+		}
+		if redactMode == "arns" {
+			resource = maskResource(service, resource)
+		}
+		return "arn:" + partition + ":" + service + ":" + region + ":" + account + ":" + resource
+	})
+
+	// bare account IDs, e.g. in keys or matrix-csv columns. Numbers right after
+	// a ':' or '|' are counters in stats and tables, not accounts, and the
+	// all-digit last group of a UUID eventID or requestID is no account either.
+	var b strings.Builder
+	last := 0
+	for _, loc := range accountIDIn.FindAllStringIndex(s, -1) {
+		prev := strings.TrimRight(s[:loc[0]], " ")
+		if strings.HasSuffix(prev, ":") || strings.HasSuffix(prev, "|") || hexIDTail(s[:loc[0]]) {
+			continue
+		}
+		b.WriteString(s[last:loc[0]])
+		b.WriteString(pseudonym("acct", s[loc[0]:loc[1]]))
+		last = loc[1]
+	}
+	b.WriteString(s[last:])
+	return []byte(b.String())
+}
+
+// hexIDTail reports whether what comes right before a digit run ends in a
+// dash-joined group of hex digits, as the groups of a UUID do: the run
+// continues an identifier rather than standing on its own
+func hexIDTail(before string) bool {
+	if !strings.HasSuffix(before, "-") {
+		return false
+	}
+	group := before[:len(before)-1]
+	n := 0
+	for n < len(group) && n < 4 && isHexDigit(group[len(group)-1-n]) {
+		n++
+	}
+	return n == 4
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// maskResource keeps an ARN resource's type (role/, user/, secret:, ...) and
+// replaces its name. S3 ARNs have no type; the bucket name is the resource.
+func maskResource(service, resource string) string {
+	if i := strings.IndexAny(resource, "/:"); i > 0 && service != "s3" {
+		return resource[:i+1] + pseudonym("res", resource[i+1:])
+	}
+	return pseudonym("res", resource)
+}
+
+// redactWriter redacts everything written through it. Every write has to
+// hold whole identifiers, which holds for the line-at-a-time report writers.
+type redactWriter struct {
+	w io.Writer
+}
+
+func (rw redactWriter) Write(p []byte) (int, error) {
+	if _, err := rw.w.Write(redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// secretSuffixRe matches the random suffix Secrets Manager appends to a
+// secret's name in its full ARN, e.g. prod/db-a1B2c3
+var secretSuffixRe = regexp.MustCompile(`-[A-Za-z0-9]{6}$`)
+
+// secretKey reduces a secret reference (name, partial ARN or full ARN) to the
+// bare secret name so different spellings of one secret collapse together
+func secretKey(ref string) string {
+	if !strings.HasPrefix(ref, "arn:") {
+		return ref
+	}
+	_, name, ok := strings.Cut(ref, ":secret:")
+	if !ok {
+		return ref
+	}
+	return secretSuffixRe.ReplaceAllString(name, "")
+}
+
+// secretRefs collects the secrets a Secrets Manager read touched: secretId
+// and BatchGetSecretValue's secretIdList from the request, plus any secret
+// ARNs CloudTrail listed under resources
+func secretRefs(params map[string]interface{}, resources []string) []string {
+	var refs []string
+	if sid, ok := params["secretId"].(string); ok && sid != "" {
+		refs = append(refs, sid)
+	}
+	if list, ok := params["secretIdList"].([]interface{}); ok {
+		for _, v := range list {
+			if sid, ok := v.(string); ok && sid != "" {
+				refs = append(refs, sid)
+			}
+		}
+	}
+	for _, arn := range resources {
+		if strings.HasPrefix(arn, "arn:") && strings.Contains(arn, ":secretsmanager:") {
+			refs = append(refs, arn)
+		}
+	}
+	return refs
+}
+
+// addSecret records a secret reference, keeping the most specific spelling
+// seen for it: a full ARN beats a name
+func (r *results) addSecret(ref string) {
+	key := secretKey(ref)
+	if prev, ok := r.secrets[key]; ok && (strings.HasPrefix(prev, "arn:") || !strings.HasPrefix(ref, "arn:")) {
+		return
+	}
+	r.secrets[key] = ref
+}
+
+// secretList returns the recorded secrets, sorted by name
+func (r *results) secretList() []string {
+	keys := make([]string, 0, len(r.secrets))
+	for k := range r.secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]string, len(keys))
+	for i, k := range keys {
+		list[i] = r.secrets[k]
+	}
+	return list
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"slices"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// selftestLogs is a tiny synthetic CloudTrail delivery, laid out and
+// compressed the way CloudTrail writes it to S3
+//
+//go:embed selftest/*.json.gz
+var selftestLogs embed.FS
+
+// selftestIdentity performed every action in the sample, except one call
+// that failed; another principal's event is mixed in as well
+const selftestIdentity = "arn:aws:sts::123456789012:assumed-role/selftest-role/session"
+
+var (
+	selftestActions = []string{
+		"ec2:DescribeInstances",
+		"iam:CreateAccessKey",
+		"s3:ListBuckets",
+		"secretsmanager:GetSecretValue",
+		"sts:GetCallerIdentity",
+	}
+	selftestSecrets = []string{"selftest/db-password"}
+)
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Run the processing pipeline against bundled sample logs, without AWS credentials",
+	Args:  cobra.NoArgs,
+	RunE:  runSelftest,
+}
+
+// runSelftest feeds the embedded logs through the same decoding and matching
+// code a real scan uses and checks what comes out
+func runSelftest(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	id := normalizeArn(selftestIdentity)
+	res := newResults()
+	sc := &scanner{targets: map[string]*results{id: res}, stats: &scanStats{}, now: time.Now()}
+
+	files, err := fs.Glob(selftestLogs, "selftest/*.json.gz")
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		f, err := selftestLogs.Open(name)
+		if err != nil {
+			return err
+		}
+		_, err = sc.scan(context.Background(), f)
+		f.Close()
+		if err != nil {
+			return inStage(stageDecode, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	failed := 0
+	check := func(what string, ok bool) {
+		status := "ok"
+		if !ok {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("%-4s %s\n", status, what)
+	}
+	check(fmt.Sprintf("decoded %d sample log files", len(files)), len(files) == 2)
+	check("examined 7 records", sc.stats.RecordsExamined == 7)
+	check(fmt.Sprintf("matched 5 records for %s", id), sc.stats.RecordsMatched == 5)
+	check(fmt.Sprintf("found actions %v", selftestActions), slices.Equal(sortedKeys(res.actions), selftestActions))
+	_, failedCall := res.actions["ec2:TerminateInstances"]
+	check("ignored the failed call", !failedCall)
+	check(fmt.Sprintf("found secrets %v", selftestSecrets), slices.Equal(res.secretList(), selftestSecrets))
+	escalation := false
+	for _, fd := range res.findings() {
+		if fd.Category == "Privilege escalation" && slices.Contains(fd.Actions, "iam:CreateAccessKey") {
+			escalation = true
+		}
+	}
+	check("flagged iam:CreateAccessKey as privilege escalation", escalation)
+
+	if failed > 0 {
+		return fmt.Errorf("selftest: %d check(s) failed", failed)
+	}
+	fmt.Println("selftest passed")
+	return nil
+}
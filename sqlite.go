@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the pure-Go "sqlite" driver
+)
+
+// sqliteSchema is created on first use and left alone afterwards, so one
+// database accumulates scan after scan; every row carries the scan it came
+// from
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS scans (
+	id INTEGER PRIMARY KEY,
+	finished TEXT NOT NULL,
+	buckets TEXT NOT NULL,
+	prefixes TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS identities (
+	scan_id INTEGER NOT NULL REFERENCES scans(id),
+	identity TEXT NOT NULL,
+	first_seen TEXT,
+	last_seen TEXT,
+	score INTEGER NOT NULL,
+	bytes_out INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS actions (
+	scan_id INTEGER NOT NULL REFERENCES scans(id),
+	identity TEXT NOT NULL,
+	action TEXT NOT NULL,
+	count INTEGER NOT NULL,
+	last_seen TEXT,
+	bytes_out INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS resources (
+	scan_id INTEGER NOT NULL REFERENCES scans(id),
+	identity TEXT NOT NULL,
+	arn TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS secrets (
+	scan_id INTEGER NOT NULL REFERENCES scans(id),
+	identity TEXT NOT NULL,
+	name TEXT NOT NULL,
+	reference TEXT NOT NULL
+);
+`
+
+// sqlNull stores an empty string as NULL
+func sqlNull(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// writeSQLite appends the scan to the --sqlite database: a scans row, then
+// the rows of every identity in idResults, all in one transaction so an
+// interrupted write leaves the database as it was
+func writeSQLite(file string, idResults map[string]*results) error {
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		return fmt.Errorf("--sqlite %s: %w", file, err)
+	}
+	defer db.Close()
+	if err := recordScan(db, idResults); err != nil {
+		return fmt.Errorf("--sqlite %s: %w", file, err)
+	}
+	return db.Close()
+}
+
+func recordScan(db *sql.DB, idResults map[string]*results) error {
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	r, err := tx.Exec("INSERT INTO scans (finished, buckets, prefixes) VALUES (?, ?, ?)",
+		time.Now().UTC().Format(time.RFC3339), strings.Join(buckets, ","), strings.Join(prefixes, ","))
+	if err != nil {
+		return err
+	}
+	scanID, err := r.LastInsertId()
+	if err != nil {
+		return err
+	}
+	var stmts [4]*sql.Stmt
+	for i, q := range []string{
+		"INSERT INTO identities (scan_id, identity, first_seen, last_seen, score, bytes_out) VALUES (?, ?, ?, ?, ?, ?)",
+		"INSERT INTO actions (scan_id, identity, action, count, last_seen, bytes_out) VALUES (?, ?, ?, ?, ?, ?)",
+		"INSERT INTO resources (scan_id, identity, arn) VALUES (?, ?, ?)",
+		"INSERT INTO secrets (scan_id, identity, name, reference) VALUES (?, ?, ?, ?)",
+	} {
+		if stmts[i], err = tx.Prepare(q); err != nil {
+			return err
+		}
+		defer stmts[i].Close()
+	}
+	insIdentity, insAction, insResource, insSecret := stmts[0], stmts[1], stmts[2], stmts[3]
+
+	for _, id := range sortedKeys(idResults) {
+		res := idResults[id]
+		first, last := "", ""
+		if !res.first.IsZero() {
+			first, last = res.first.Format(time.RFC3339), res.last.Format(time.RFC3339)
+		}
+		if _, err := insIdentity.Exec(scanID, id, sqlNull(first), sqlNull(last), riskScore(res.findings()), res.bytesOut); err != nil {
+			return err
+		}
+		for _, a := range sortedKeys(res.actions) {
+			st := res.actions[a]
+			if _, err := insAction.Exec(scanID, id, a, st.Count, sqlNull(st.LastSeen), st.BytesOut); err != nil {
+				return err
+			}
+		}
+		for _, arn := range sortedSet(res.resources) {
+			if _, err := insResource.Exec(scanID, id, arn); err != nil {
+				return err
+			}
+		}
+		for _, name := range sortedKeys(res.secrets) {
+			if _, err := insSecret.Exec(scanID, id, name, res.secrets[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
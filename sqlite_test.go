@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteSQLite(t *testing.T) {
+	res := newResults()
+	res.actions["s3:GetObject"] = &actionStat{Count: 3, LastSeen: "2024-05-01T00:00:00Z"}
+	res.actions["iam:ListRoles"] = &actionStat{Count: 1}
+	res.resources["arn:aws:s3:::bucket/it's-quoted"] = struct{}{}
+	res.secrets["prod/db"] = "arn:aws:secretsmanager:us-east-1:111111111111:secret:prod/db"
+	idResults := map[string]*results{"arn:aws:iam::111111111111:role/O'Brien": res}
+
+	file := filepath.Join(t.TempDir(), "audit.db")
+	// a second scan appends to the same database
+	for i := 0; i < 2; i++ {
+		if err := writeSQLite(file, idResults); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, c := range []struct {
+		query string
+		want  int
+	}{
+		{"SELECT count(*) FROM scans", 2},
+		{"SELECT count(DISTINCT scan_id) FROM identities WHERE identity = 'arn:aws:iam::111111111111:role/O''Brien'", 2},
+		{"SELECT count(*) FROM actions WHERE scan_id = 2", 2},
+		{"SELECT sum(count) FROM actions WHERE action = 's3:GetObject'", 6},
+		{"SELECT count(*) FROM actions WHERE last_seen IS NULL", 2},
+		{"SELECT count(*) FROM resources WHERE arn = 'arn:aws:s3:::bucket/it''s-quoted'", 2},
+		{"SELECT count(*) FROM secrets WHERE name = 'prod/db'", 2},
+	} {
+		var got int
+		if err := db.QueryRow(c.query).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if got != c.want {
+			t.Errorf("%s = %d, want %d", c.query, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+)
+
+// tagFilter keeps only events whose resources carry a given tag. CloudTrail
+// rarely records tags inline, so they're fetched from the Resource Groups
+// Tagging API and cached per ARN.
+type tagFilter struct {
+	cfg   aws.Config
+	key   string
+	value string
+	// with --assume-all-org-accounts, each account's resources are looked
+	// up as that account's role
+	roles *accountRoles
+
+	mu      sync.Mutex
+	clients map[string]*resourcegroupstaggingapi.Client
+	cache   map[string]bool
+}
+
+func newTagFilter(cfg aws.Config, spec string) (*tagFilter, error) {
+	key, value, ok := strings.Cut(spec, "=")
+	if !ok || key == "" {
+		return nil, fmt.Errorf("--resource-tag must be key=value, got %q", spec)
+	}
+	return &tagFilter{
+		cfg:     cfg,
+		key:     key,
+		value:   value,
+		clients: make(map[string]*resourcegroupstaggingapi.Client),
+		cache:   make(map[string]bool),
+	}, nil
+}
+
+// matches reports whether any of the ARNs carries the tag. Events without
+// resource ARNs can't be attributed to a team and never match. account is the
+// event's recipient account, for ARNs (S3's) that don't name one.
+func (t *tagFilter) matches(ctx context.Context, account string, arns []string) bool {
+	var missing []string
+	t.mu.Lock()
+	for _, a := range arns {
+		tagged, ok := t.cache[a]
+		if !ok {
+			missing = append(missing, a)
+			continue
+		}
+		if tagged {
+			t.mu.Unlock()
+			return true
+		}
+	}
+	t.mu.Unlock()
+
+	found := false
+	for _, a := range missing {
+		if t.lookup(ctx, account, a) {
+			found = true
+		}
+	}
+	return found
+}
+
+// lookup fetches the tags for one ARN and caches the result; lookup failures
+// are reported and treated as untagged
+func (t *tagFilter) lookup(ctx context.Context, account, arn string) bool {
+	if a := arnAccount(arn); a != "" {
+		account = a
+	}
+	out, err := t.client(arnRegion(arn), account).GetResources(ctx, &resourcegroupstaggingapi.GetResourcesInput{
+		ResourceARNList: []string{arn},
+	})
+	tagged := false
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tag lookup error for %s: %v\n", arn, err)
+	} else {
+		for _, m := range out.ResourceTagMappingList {
+			for _, tag := range m.Tags {
+				if aws.ToString(tag.Key) == t.key && aws.ToString(tag.Value) == t.value {
+					tagged = true
+				}
+			}
+		}
+	}
+	t.mu.Lock()
+	t.cache[arn] = tagged
+	t.mu.Unlock()
+	return tagged
+}
+
+// client returns a tagging client for the region and account, since the API
+// only sees resources in the region and account it's called in
+func (t *tagFilter) client(region, account string) *resourcegroupstaggingapi.Client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.roles.has(account) {
+		// everything without its own role shares the default credentials
+		account = ""
+	}
+	key := region + "/" + account
+	cli, ok := t.clients[key]
+	if !ok {
+		cfg := t.roles.config(account, t.cfg).Copy()
+		cfg.Region = region
+		cli = resourcegroupstaggingapi.NewFromConfig(cfg)
+		t.clients[key] = cli
+	}
+	return cli
+}
+
+// arnRegion extracts the region field of an ARN, falling back to us-east-1
+// for global resources
+func arnRegion(arn string) string {
+	parts := strings.SplitN(arn, ":", 5)
+	if len(parts) < 5 || parts[3] == "" {
+		return "us-east-1"
+	}
+	return parts[3]
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// outputTemplate is the parsed --template, nil when unset
+var outputTemplate *template.Template
+
+// templateFuncs are available to --template on top of the text/template builtins
+var templateFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// parseTemplate reads --template: a path to a template file, or the template
+// text itself when no such file exists
+func parseTemplate(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	text, name := spec, "--template"
+	if data, err := os.ReadFile(spec); err == nil {
+		text, name = string(data), spec
+	}
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return fmt.Errorf("--template: %w", err)
+	}
+	outputTemplate = t
+	return nil
+}
+
+// writeTemplate executes --template against the same report the json format
+// emits, so its fields are documented by that output (.Identity, .Actions,
+// .Findings, .Stats.RecordsMatched, ...)
+func writeTemplate(file, identity string, keys []string, res *results, stats *scanStats) error {
+	report := newJSONReport(identity, keys, res)
+	report.Stats = stats
+	var b bytes.Buffer
+	if err := outputTemplate.Execute(&b, report); err != nil {
+		return fmt.Errorf("--template: %w", err)
+	}
+	return emit(file, bytes.TrimRight(b.Bytes(), "\n"))
+}
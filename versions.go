@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// latestEventVersion is the newest CloudTrail record format the fields read
+// here were checked against; a newer one may have moved or renamed some
+const latestEventVersion = "1.11"
+
+// noEventVersion stands in for records that carried no eventVersion
+const noEventVersion = "none"
+
+// countVersion tallies one examined record's eventVersion
+func (st *scanStats) countVersion(v string) {
+	if v == "" {
+		v = noEventVersion
+	}
+	n, ok := st.versions.Load(v)
+	if !ok {
+		n, _ = st.versions.LoadOrStore(v, new(int64))
+	}
+	atomic.AddInt64(n.(*int64), 1)
+}
+
+// collectVersions copies the tallies into EventVersions once the workers are
+// done
+func (st *scanStats) collectVersions() {
+	st.versions.Range(func(k, v any) bool {
+		if st.EventVersions == nil {
+			st.EventVersions = make(map[string]int64)
+		}
+		st.EventVersions[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+}
+
+// parseEventVersion splits a "major.minor" eventVersion into its numbers
+func parseEventVersion(v string) (major, minor int, ok bool) {
+	a, b, found := strings.Cut(v, ".")
+	if !found {
+		return 0, 0, false
+	}
+	major, err1 := strconv.Atoi(a)
+	minor, err2 := strconv.Atoi(b)
+	return major, minor, err1 == nil && err2 == nil
+}
+
+// unexpectedVersions lists the versions seen that are newer than
+// latestEventVersion or don't parse as one, sorted
+func unexpectedVersions(seen map[string]int64) []string {
+	latestMajor, latestMinor, _ := parseEventVersion(latestEventVersion)
+	var out []string
+	for _, v := range sortedKeys(seen) {
+		if v == noEventVersion {
+			continue
+		}
+		major, minor, ok := parseEventVersion(v)
+		if !ok || major > latestMajor || major == latestMajor && minor > latestMinor {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// warnVersionDrift tells the user when records came in a format this build
+// doesn't know, since fields it reads may have moved
+func warnVersionDrift(w io.Writer, seen map[string]int64) {
+	drift := unexpectedVersions(seen)
+	if len(drift) == 0 {
+		return
+	}
+	var n int64
+	for _, v := range drift {
+		n += seen[v]
+	}
+	fmt.Fprintf(w, "\nWARNING: %d record(s) have eventVersion %s, newer than the %s entrails was written for; some fields may not have been read.\n",
+		n, strings.Join(drift, ", "), latestEventVersion)
+}
+
+// versionSummary renders the version distribution as "1.08 (12), 1.09 (340)"
+func versionSummary(seen map[string]int64) string {
+	parts := make([]string, 0, len(seen))
+	for _, v := range sortedKeys(seen) {
+		parts = append(parts, fmt.Sprintf("%s (%d)", v, seen[v]))
+	}
+	return strings.Join(parts, ", ")
+}
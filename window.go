@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deliveryLag is how late CloudTrail may deliver a log file after its
+// events, so a file dated the day after --end-time can still hold events
+// from within the window
+const deliveryLag = 15 * time.Minute
+
+// the --start-time/--end-time window as whole UTC days, zero when unset
+var firstDay, lastDay time.Time
+
+// the exact window events are held to; windowEnd is zero without --end-time
+var windowStart, windowEnd time.Time
+
+// parseWindowTime reads a --start-time or --end-time value: RFC 3339, or a
+// bare date. A date starts the window at its midnight UTC and ends it with
+// the last instant of that day, so --end-time 2024-03-05 takes in the 5th.
+func parseWindowTime(flag, spec string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, spec); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, spec); err == nil {
+		if flag == "end-time" {
+			return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("--%s wants an RFC 3339 time (2024-01-15T10:00:00Z) or a date (2024-01-15), got %q", flag, spec)
+}
+
+// setWindowDays records the UTC days whose log files can hold events from
+// start to end
+func setWindowDays(start, end time.Time) {
+	firstDay = start.UTC().Truncate(24 * time.Hour)
+	lastDay = end.Add(deliveryLag).UTC().Truncate(24 * time.Hour)
+}
+
+var yearSegRe = regexp.MustCompile(`^[0-9]{4}$`)
+
+// datePrefixes narrows a shard that ends in a trail's <region>/<year>/
+// folder to the folders of the window within that year, which may be none:
+// the year itself when the window spans all of it, a month folder for every
+// month it spans, and day folders for the rest. ok is false for any other
+// shard, which is listed whole.
+func datePrefixes(prefix string) (folders []string, ok bool) {
+	segs := strings.Split(strings.TrimSuffix(prefix, "/"), "/")
+	if len(segs) < 2 || !yearSegRe.MatchString(segs[len(segs)-1]) || !regionSegRe.MatchString(segs[len(segs)-2]) {
+		return nil, false
+	}
+	year, _ := strconv.Atoi(segs[len(segs)-1])
+	base := strings.TrimSuffix(prefix, "/") + "/"
+	covers := func(from, to time.Time) bool { return !from.Before(firstDay) && !to.After(lastDay) }
+	jan1 := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	if covers(jan1, jan1.AddDate(1, 0, -1)) {
+		return []string{base}, true
+	}
+	for month := jan1; month.Year() == year; month = month.AddDate(0, 1, 0) {
+		if covers(month, month.AddDate(0, 1, -1)) {
+			folders = append(folders, base+month.Format("01/"))
+			continue
+		}
+		for d := month; d.Month() == month.Month(); d = d.AddDate(0, 0, 1) {
+			if covers(d, d) {
+				folders = append(folders, base+d.Format("01/02/"))
+			}
+		}
+	}
+	return folders, true
+}
+
+// eventInWindow reports whether an event at t falls in the
+// --start-time/--end-time window, both ends included. Log files of the
+// window's days also hold events from either side of it, and a keys file or
+// stdin isn't pruned at all. Events whose time couldn't be read (ok false)
+// are kept.
+func eventInWindow(t time.Time, ok bool) bool {
+	if windowStart.IsZero() || !ok {
+		return true
+	}
+	return !t.Before(windowStart) && (windowEnd.IsZero() || !t.After(windowEnd))
+}
+
+// keyDateRe finds the /YYYY/MM/DD/ folders in a CloudTrail key
+var keyDateRe = regexp.MustCompile(`/([0-9]{4})/([0-9]{2})/([0-9]{2})/`)
+
+// inWindow reports whether a listed key's date folders fall in the window.
+// Keys without them, in a layout that wasn't recognized, are kept.
+func inWindow(key string) bool {
+	if firstDay.IsZero() {
+		return true
+	}
+	m := keyDateRe.FindStringSubmatch(key)
+	if m == nil {
+		return true
+	}
+	d, err := time.Parse("2006/01/02", m[1]+"/"+m[2]+"/"+m[3])
+	if err != nil {
+		return true
+	}
+	return !d.Before(firstDay) && !d.After(lastDay)
+}